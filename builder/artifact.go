@@ -0,0 +1,169 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/otiai10/copy"
+	"github.com/rs/zerolog/log"
+)
+
+// ArtifactInfo describes a file kept as an artifact of a run.
+type ArtifactInfo struct {
+	// Name is the path of the file relative to the workspace, e.g. "bin/app".
+	Name   string `json:"name"`
+	Task   string `json:"task"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArtifactManifest lists the artifacts kept by a run.
+type ArtifactManifest struct {
+	RunID     string          `json:"runId"`
+	Artifacts []*ArtifactInfo `json:"artifacts"`
+}
+
+var manifestMu sync.Mutex
+
+// Artifacts keeps the files matching the glob patterns once the task has succeeded, by copying
+// them into the artifact directory of the run. `**` matches any number of directories.
+func (t *Task) Artifacts(patterns ...string) *Task {
+	t.artifacts = append(t.artifacts, patterns...)
+	return t
+}
+
+func artifactsDir(runDir string) string {
+	return filepath.Join(runDir, "artifacts")
+}
+
+// collectArtifacts copies the task's artifacts into the run directory and adds them to its manifest.
+func (t *Task) collectArtifacts() error {
+	dir, err := currentRunDir()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	files, err := globFiles(".", t.artifacts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(files) == 0 {
+		log.Warn().Msgf("No artifacts of %s matched %v", t.label(), t.artifacts)
+		return nil
+	}
+	infos := []*ArtifactInfo{}
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		sum, err := hashFile(file)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		dest := filepath.Join(artifactsDir(dir), "files", file)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return errors.Trace(err)
+		}
+		if err := copy.Copy(file, dest); err != nil {
+			return errors.Annotatef(err, "failed to copy artifact '%s'", file)
+		}
+		infos = append(infos, &ArtifactInfo{Name: file, Task: t.displayName(), Size: stat.Size(), SHA256: sum})
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	manifest, err := readArtifactManifest(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	manifest.RunID = filepath.Base(dir)
+	for _, info := range infos {
+		replaced := false
+		for i, existing := range manifest.Artifacts {
+			if existing.Name == info.Name {
+				log.Warn().Msgf("Artifact '%s' of %s replaces the one kept by '%s'", info.Name, t.label(), existing.Task)
+				manifest.Artifacts[i] = info
+				replaced = true
+			}
+		}
+		if !replaced {
+			manifest.Artifacts = append(manifest.Artifacts, info)
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(artifactsDir(dir), "manifest.json"), data, 0644)
+	if err != nil {
+		return errors.Annotatef(err, "failed to write artifact manifest")
+	}
+	log.Info().Msgf("Kept %d artifacts of %s", len(infos), t.label())
+	return nil
+}
+
+func readArtifactManifest(runDir string) (*ArtifactManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(artifactsDir(runDir), "manifest.json"))
+	if os.IsNotExist(err) {
+		return &ArtifactManifest{}, nil
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read artifact manifest")
+	}
+	manifest := &ArtifactManifest{}
+	err = json.Unmarshal(data, manifest)
+	return manifest, errors.Annotatef(err, "failed to parse artifact manifest")
+}
+
+// ListArtifacts returns the manifest of the artifacts kept by a run. An empty runID means the current run.
+func ListArtifacts(runID string) (*ArtifactManifest, error) {
+	dir, err := runDirOf(runID)
+	if err != nil {
+		return nil, err
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	return readArtifactManifest(dir)
+}
+
+// ArtifactPath returns the path of an artifact kept by a run. An empty runID means the current run.
+func ArtifactPath(runID, name string) (string, error) {
+	manifest, err := ListArtifacts(runID)
+	if err != nil {
+		return "", err
+	}
+	dir, _ := runDirOf(runID)
+	for _, info := range manifest.Artifacts {
+		if info.Name == filepath.ToSlash(filepath.Clean(name)) {
+			return filepath.Join(artifactsDir(dir), "files", info.Name), nil
+		}
+	}
+	return "", errors.NotFoundf("artifact '%s' in run '%s'", name, manifest.RunID)
+}
+
+// FetchArtifact copies an artifact kept by a run to dest. An empty runID means the current run.
+func FetchArtifact(runID, name, dest string) error {
+	src, err := ArtifactPath(runID, name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotatef(copy.Copy(src, dest), "failed to fetch artifact '%s'", name)
+}
+
+// runDirOf returns the directory of the run with the given ID, or of the current run if runID is empty.
+func runDirOf(runID string) (string, error) {
+	if runID == "" {
+		return currentRunDir()
+	}
+	dir := filepath.Join(runsDir(), runID)
+	if _, err := os.Stat(dir); err != nil {
+		return "", errors.NotFoundf("run '%s'", runID)
+	}
+	return dir, nil
+}
@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func artifactNames(t *testing.T, runID string) string {
+	t.Helper()
+	manifest, err := ListArtifacts(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range manifest.Artifacts {
+		names = append(names, info.Name+"@"+info.Task)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestArtifacts(t *testing.T) {
+	inTempWorkspace(t)
+	startTestRun(t)
+	build := Step("build", func() {
+		writeFile(t, "bin/app", "app v1")
+		writeFile(t, "bin/debug/app.sym", "symbols")
+		writeFile(t, "bin/notes.txt", "notes")
+	}).Artifacts("bin/**/app*")
+	rebuild := Step("rebuild", func() {
+		writeFile(t, "bin/app", "app v2")
+	}).Artifacts("bin/app")
+	broken := Step("broken", func() error {
+		writeFile(t, "dist/broken.tar", "")
+		return errors.New("does not package")
+	}).Artifacts("dist/*").NoFailOnError()
+	root := Stage("root", build, rebuild, broken, Step("nothing", noop).Artifacts("missing/*"))
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if got := artifactNames(t, ""); got != "bin/app@rebuild bin/debug/app.sym@build" {
+		t.Errorf("got artifacts %s", got)
+	}
+	if got := artifactNames(t, RunID()); got != "bin/app@rebuild bin/debug/app.sym@build" {
+		t.Errorf("got artifacts %s of the run by its ID", got)
+	}
+	dest := filepath.Join(t.TempDir(), "app")
+	if err := FetchArtifact(RunID(), "./bin/app", dest); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dest)
+	if err != nil || string(data) != "app v2" {
+		t.Errorf("fetched %q, %v", data, err)
+	}
+	manifest, _ := ListArtifacts("")
+	if info := manifest.Artifacts[0]; info.Size != 6 || info.SHA256 != "10fb2ebd7b01ffc6a52fad0f99a1471f37e85f67b59b102e1f6d080d3f0b8afb" || manifest.RunID != RunID() {
+		t.Errorf("got %+v in run %s", info, manifest.RunID)
+	}
+	if _, err := ArtifactPath("", "bin/notes.txt"); !errors.IsNotFound(err) {
+		t.Errorf("got %v for an artifact that was not kept", err)
+	}
+	if _, err := ListArtifacts("20260101-000000-000000"); !errors.IsNotFound(err) {
+		t.Errorf("got %v for a run that does not exist", err)
+	}
+}
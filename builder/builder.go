@@ -1,16 +1,19 @@
 package builder
 
 import (
-	"bytes"
+	"context"
+	"flag"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/homelabtools/nanoci/codegen"
 	"github.com/homelabtools/nanoci/mirror"
@@ -28,16 +31,25 @@ type ContextFunc func(Args) error
 // Context represents an external environment in which a ContextFunc is run, such as a Docker container or a VM
 type Context struct {
 	fn       ContextFunc
-	TaskFunc func(Args) error
+	TaskFunc func(context.Context, Args) error
 	funcInfo *mirror.FunctionInfo
 }
 
 func init() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: consoleWriter{masker.Writer(os.Stderr)}})
 }
 
-// BuilderMain is the setup function that should be called be builder.go's main function
+// BuilderMain is the setup function that should be called be builder.go's main function.
+// It parses the command line, see --help for the options.
 func BuilderMain() {
+	err := parseArgs(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 }
 
 func BuilderExit(err error) {
@@ -47,10 +59,108 @@ func BuilderExit(err error) {
 	os.Exit(0)
 }
 
-// Begin starts a workflow of stages
-func Begin(stages ...*Task) {
-	all := Stage("root", stages...)
-	all.fn()
+// Begin starts a workflow of stages. The stages run one after another, unless any of them declare
+// dependencies with DependsOn, in which case they are scheduled as a dependency graph: a stage with
+// dependencies starts as soon as they have finished, while the others still start after the stage
+// before them, and not at all once it has failed.
+// An interrupt or termination signal cancels the workflow and kills any running commands, after
+// which hooks such as Finally still run, unless a second signal aborts them as well.
+// When the workflow is finished a summary is printed, the result of every task is returned
+// and recorded in the run history, and notifications are sent, see Notify.
+func Begin(stages ...*Task) *Result {
+	for _, stage := range stages {
+		expandMatrices(stage)
+	}
+	var all *Task
+	if hasDependencies(stages) {
+		all = Graph("root", stages...)
+		all.ordered = true
+	} else {
+		all = Stage("root", stages...)
+	}
+	all.callLocation = callerLocation(1)
+	all.timeout = pipeline.timeout
+	all.inactivityTimeout = pipeline.inactivityTimeout
+	all.hooks = pipeline.hooks
+	all.env = pipeline.env
+	all.dir = pipeline.dir
+	expandMatrices(all)
+	if err := resolveDependencies(all); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	walkTasks(all, "", func(t *Task, taskPath string, depth int) {
+		t.path = taskPath
+		register(t)
+	})
+	if err := applySelection(all); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	if err := checkNotifications(); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	if cli.list {
+		printTaskTree(os.Stdout, all)
+		return all.Result()
+	}
+	switch cli.plan {
+	case "text":
+		all.Plan().Print(os.Stdout)
+		return all.Result()
+	case "json":
+		all.Plan().WriteJSON(os.Stdout)
+		return all.Result()
+	}
+	switch cli.graph {
+	case "dot":
+		all.Result().WriteDOT(os.Stdout, false)
+		return all.Result()
+	case "mermaid":
+		all.Result().WriteMermaid(os.Stdout, false)
+		return all.Result()
+	}
+	// A first signal cancels the workflow, which still runs its hooks, a second one aborts the hooks too
+	abortCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), abortKey, abortCtx))
+	defer cancel()
+	setRunContext(ctx)
+	defer setRunContext(nil)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	if err := startRun(); err != nil {
+		log.Error().Msgf("Unable to start run: %s", errors.ErrorStack(err))
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warn().Msgf("Received %s, cancelling pipeline, send it again to stop its cleanup as well", sig)
+			cancel()
+		case <-finished:
+			return
+		}
+		select {
+		case sig := <-signals:
+			log.Warn().Msgf("Received %s again, aborting pipeline", sig)
+			abort()
+		case <-finished:
+		}
+	}()
+	if err := callTask(ctx, all); err != nil {
+		log.Error().Msgf("Pipeline failed: %s", err)
+	}
+	result := all.Result()
+	result.PrintSummary(os.Stderr)
+	record := newRunRecord(result)
+	if err := saveRun(record); err != nil {
+		log.Error().Msgf("Unable to record run: %s", errors.ErrorStack(err))
+	} else {
+		log.Info().Msgf("Run %s recorded in %s", RunID(), RunDir())
+	}
+	sendNotifications(record)
+	return result
 }
 
 // ExternalProcess runs a ContextFunc in another process
@@ -60,14 +170,37 @@ func ExternalProcess(fn ContextFunc) *Context {
 		panic(err)
 	}
 	wd, _ := os.Getwd()
-	taskFn := func(args Args) error {
+	taskFn := func(ctx context.Context, args Args) error {
 		p, err := codegen.ProgramizeFunctionAt(fi, path.Join(wd, "..", "func"))
 		//p, err := codegen.CreateProgramFromFunction(fi)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		//defer p.Remove()
-		return errors.Trace(p.Run(args))
+		out, err := newOutputFile(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer out.remove()
+		p.Env, err = commandEnv(ctx, out.env()...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		p.WorkDir = workDir(ctx)
+		stdout := commandWriter(ctx, os.Stdout)
+		stderr := commandWriter(ctx, os.Stderr)
+		p.Stdout = stdout
+		p.Stderr = recordStderr(ctx, stderr)
+		err = p.RunContext(ctx, args)
+		stdout.Flush()
+		stderr.Flush()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if out != nil {
+			return errors.Trace(out.collect())
+		}
+		return nil
 	}
 	return &Context{
 		funcInfo: fi,
@@ -76,11 +209,19 @@ func ExternalProcess(fn ContextFunc) *Context {
 	}
 }
 
-// Inside runs something inside another context, like a container or a VM
-func Inside(context *Context, args Args) *Task {
+// Inside runs something inside another context, like a container or a VM.
+// Any OutputRef values in args are replaced with the outputs they refer to when the task starts.
+func Inside(external *Context, args Args) *Task {
 	task := &Task{
-		fn: func() error {
-			return context.TaskFunc(args)
+		kind:         "inside",
+		callLocation: callerLocation(1),
+		external:     external,
+		fn: func(ctx context.Context) error {
+			resolved, err := resolveArgs(args)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return external.TaskFunc(ctx, resolved)
 		},
 	}
 	return task
@@ -90,8 +231,62 @@ func Inside(context *Context, args Args) *Task {
 type Task struct {
 	callLocation  string
 	name          string
-	fn            func() error
+	kind          string
+	fn            func(context.Context) error
 	noFailOnError bool
+	dependsOn     []*Task
+	// after is the sibling the task starts after in a graph whose children keep their order, see ordered.
+	after *Task
+	// ordered makes the children of a graph that declare no dependencies start after the child before
+	// them, as the stages given to Begin do.
+	ordered bool
+
+	failFast       bool
+	maxConcurrency int
+
+	timeout           time.Duration
+	inactivityTimeout time.Duration
+
+	retry          *RetryPolicy
+	attempts       int
+	attemptResults []AttemptResult
+
+	conditions []Condition
+
+	children []*Task
+	matrix   *matrixSpec
+
+	outputs map[string]string
+	output  lockedBuffer
+
+	cache       *CacheOptions
+	cacheStatus string
+
+	artifacts []string
+
+	deselected string
+	external   *Context
+
+	env envScope
+	dir string
+
+	path      string
+	logFile   *os.File
+	logFailed bool
+
+	groupOutput bool
+
+	hooks hooks
+
+	mu         sync.Mutex
+	done       chan struct{}
+	status     Status
+	skipReason string
+	// blocked is set when the task was skipped because a task it waited for failed or was blocked.
+	blocked bool
+	started time.Time
+	ended   time.Time
+	err     error
 }
 
 // NoFailOnError indicates that a task should not fail if it returns an error
@@ -109,33 +304,44 @@ func (t *Task) failureString() string {
 
 // Stage executes a sequence of tasks one after another, failing if any of the tasks fail.
 func Stage(name string, tasks ...*Task) *Task {
-	_, fn := buildTaskFunc(func() error {
+	s := &Task{name: name, kind: "stage", callLocation: callerLocation(1), children: tasks}
+	s.fn = func(ctx context.Context) error {
 		defer recoverError()
-		for _, t := range tasks {
-			err := t.fn()
+		tasks := s.children
+		for i, t := range tasks {
+			if ctx.Err() != nil {
+				for _, skipped := range tasks[i:] {
+					skipped.skip(fmt.Sprintf("stage '%s' was cancelled", name))
+				}
+				return errors.Annotatef(ctx.Err(), "stage '%s' was cancelled before %s", name, t.label())
+			}
+			err := callTask(ctx, t)
 			if err != nil && !t.noFailOnError {
 				log.Error().Msgf(t.failureString()+": %s", errors.ErrorStack(err))
+				for _, skipped := range tasks[i+1:] {
+					skipped.skip(fmt.Sprintf("%s failed earlier in stage '%s'", t.label(), name))
+				}
 				return errors.Annotatef(err, "task within stage '%s' failed", name)
 			} else if err != nil && t.noFailOnError {
 				log.Error().Msgf(t.failureString()+" in stage '%s': %s", name, errors.ErrorStack(err))
 			}
 		}
 		return nil
-	})
-	return &Task{fn: fn}
+	}
+	return s
 }
 
 // Step executes a function as a task
 //func Step(fn func() error) *Task {
 func Step(args ...interface{}) *Task {
 	defer recoverError()
-	argErrorMsg := "Invalid arguments for the Task function, must be one of:\n[name string, task func() error], [name string, task func()], [task func() error] or [task func()]"
-	task := &Task{}
+	argErrorMsg := "Invalid arguments for the Task function, must be one of:\n[name string, task func() error], [name string, task func()], [name string, task func(context.Context) error], [task func() error], [task func()] or [task func(context.Context) error]"
+	task := &Task{kind: "step"}
 	switch len(args) {
 	case 1:
 		isCorrectType, fn := buildTaskFunc(args[0])
 		if !isCorrectType {
-			panic(errors.New("The function argument for Task must be either `func() error` or `func()"))
+			panic(errors.New("The function argument for Task must be either `func() error`, `func()` or `func(context.Context) error`"))
 		}
 		task.fn = fn
 	case 2:
@@ -147,24 +353,35 @@ func Step(args ...interface{}) *Task {
 		}
 		isCorrectType, fn := buildTaskFunc(args[1])
 		if !isCorrectType {
-			panic(errors.New("The second argument for Task must be either `func() error` or `func()`"))
+			panic(errors.New("The second argument for Task must be either `func() error`, `func()` or `func(context.Context) error`"))
 		}
 		task.fn = fn
 	default:
 		panic(errors.New(argErrorMsg))
 	}
 
-	_, file, line, _ := runtime.Caller(1)
-	task.callLocation = fmt.Sprintf("%s:%d", file, line)
+	task.callLocation = callerLocation(1)
 	return task
 }
 
-func buildTaskFunc(taskFunc interface{}) (bool, func() error) {
+// callerLocation returns the file and line of the caller, skip frames above the function calling it.
+func callerLocation(skip int) string {
+	_, file, line, _ := runtime.Caller(skip + 1)
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+func buildTaskFunc(taskFunc interface{}) (bool, func(context.Context) error) {
 	switch arg1 := taskFunc.(type) {
-	case func() error:
+	case func(context.Context) error:
 		return true, arg1
+	case func() error:
+		return true, func(ctx context.Context) error {
+			defer bindContext(ctx)()
+			return arg1()
+		}
 	case func():
-		return true, func() error {
+		return true, func(ctx context.Context) error {
+			defer bindContext(ctx)()
 			arg1()
 			return nil
 		}
@@ -173,32 +390,94 @@ func buildTaskFunc(taskFunc interface{}) (bool, func() error) {
 	}
 }
 
-// Parallel runs one or more tasks in parallel
+// Parallel runs one or more tasks in parallel. Every child runs to completion and the task fails
+// with an error listing each child that failed. Use FailFast and MaxConcurrency to change this.
 func Parallel(tasks ...*Task) *Task {
-	return &Task{fn: func() error {
-		wg := sync.WaitGroup{}
-		for _, t := range tasks {
-			wg.Add(1)
-			go func(t *Task) {
-				fnErr := t.fn()
-				defer func() {
-					if err := recover(); err != nil {
-						if e, ok := err.(error); ok {
-							log.Error().Msgf("%s: %s", t.failureString(), errors.ErrorStack(e))
-						} else {
-							log.Error().Msgf("%s: %+v", t.failureString(), err)
-						}
-					}
-					if fnErr != nil {
-						log.Error().Msg(errors.ErrorStack(fnErr))
-					}
-					wg.Done()
-				}()
-			}(t)
+	p := &Task{kind: "parallel", callLocation: callerLocation(1), children: tasks}
+	p.fn = func(ctx context.Context) error {
+		return runParallel(ctx, p, p.children)
+	}
+	return p
+}
+
+// FailFast makes a parallel task stop as soon as one of its children fails.
+// Children that are still running are cancelled and children that have not started yet are skipped.
+func (t *Task) FailFast() *Task {
+	t.failFast = true
+	return t
+}
+
+// MaxConcurrency limits how many children of a parallel task may run at once. Zero means no limit.
+func (t *Task) MaxConcurrency(n int) *Task {
+	t.maxConcurrency = n
+	return t
+}
+
+func runParallel(ctx context.Context, p *Task, tasks []*Task) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limit := p.maxConcurrency
+	if limit <= 0 || limit > len(tasks) {
+		limit = len(tasks)
+	}
+	slots := make(chan struct{}, limit)
+	stop := make(chan struct{})
+	mu := sync.Mutex{}
+	stopped := false
+	failures := TaskErrors{}
+	wg := sync.WaitGroup{}
+	grouped := p.groupsOutput()
+	if grouped {
+		board.add(tasks...)
+		defer board.remove(tasks...)
+	}
+	for i, t := range tasks {
+		select {
+		case slots <- struct{}{}:
+		case <-stop:
+		case <-ctx.Done():
 		}
-		wg.Wait()
-		return nil
-	}}
+		mu.Lock()
+		if stopped || ctx.Err() != nil {
+			mu.Unlock()
+			for _, skipped := range tasks[i:] {
+				skipped.skip("a parallel task failed")
+			}
+			break
+		}
+		mu.Unlock()
+		wg.Add(1)
+		go func(t *Task) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			var err error
+			if grouped {
+				err = runGrouped(ctx, t)
+			} else {
+				err = callTask(ctx, t)
+			}
+			if err == nil {
+				return
+			}
+			log.Error().Msgf("%s: %s", t.failureString(), errors.ErrorStack(err))
+			if t.noFailOnError {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			failures = append(failures, &TaskError{Task: t, Err: err})
+			if p.failFast && !stopped {
+				stopped = true
+				close(stop)
+				cancel()
+			}
+		}(t)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		return errors.Trace(failures)
+	}
+	return nil
 }
 
 func recoverError() {
@@ -226,38 +505,99 @@ func handleError(err error) {
 	os.Exit(1)
 }
 
-// SH runs an arbitrary shell commanear
-func SH(shellCommand string) (string, string, error) {
-	cmd := exec.Command("sh", "-c", shellCommand)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", "", errors.Trace(err)
+// runContext is the context of the workflow started by Begin while it runs. It is cancelled on
+// an interrupt, which kills the commands started with SH, as they run in their own process group
+// and do not get the signal from the terminal.
+var runContext struct {
+	sync.Mutex
+	ctx context.Context
+}
+
+func setRunContext(ctx context.Context) {
+	runContext.Lock()
+	defer runContext.Unlock()
+	runContext.ctx = ctx
+}
+
+// boundContexts are the contexts of the steps without a context parameter that are running,
+// by the goroutine running them, so that SH can find the task it is called for.
+var boundContexts = struct {
+	sync.Mutex
+	m map[uint64]context.Context
+}{m: map[uint64]context.Context{}}
+
+// bindContext makes ctx the context of SH calls from the current goroutine until the returned
+// function is called.
+func bindContext(ctx context.Context) func() {
+	id := goroutineID()
+	boundContexts.Lock()
+	defer boundContexts.Unlock()
+	previous, ok := boundContexts.m[id]
+	boundContexts.m[id] = ctx
+	return func() {
+		boundContexts.Lock()
+		defer boundContexts.Unlock()
+		if ok {
+			boundContexts.m[id] = previous
+		} else {
+			delete(boundContexts.m, id)
+		}
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return "", "", errors.Trace(err)
+}
+
+// goroutineID returns the ID of the current goroutine, from the header of its stack trace.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return 0
 	}
-	stdoutBuf := &bytes.Buffer{}
-	stderrBuf := &bytes.Buffer{}
-	stdoutTee := io.TeeReader(stdout, stdoutBuf)
-	stderrTee := io.TeeReader(stderr, stderrBuf)
-	err = cmd.Start()
-	if err != nil {
-		return "", "", errors.Trace(err)
+	id, _ := strconv.ParseUint(fields[1], 10, 64)
+	return id
+}
+
+var warnUnboundSH sync.Once
+
+// shContext returns the context SH runs commands with: that of the step calling it, or that of
+// the workflow if SH is called from a goroutine the step started.
+func shContext() context.Context {
+	boundContexts.Lock()
+	ctx, ok := boundContexts.m[goroutineID()]
+	boundContexts.Unlock()
+	if ok {
+		return ctx
 	}
-	go io.Copy(os.Stdout, stdoutTee)
-	go io.Copy(os.Stderr, stderrTee)
-	err = cmd.Wait()
-	stdoutContents := strings.TrimSpace(string(stdoutBuf.Bytes()))
-	stderrContents := strings.TrimSpace(string(stderrBuf.Bytes()))
-	if err != nil {
-		return "", "", errors.Trace(err)
+	runContext.Lock()
+	defer runContext.Unlock()
+	if runContext.ctx == nil {
+		return context.Background()
 	}
-	if err != nil {
-		if e, ok := err.(*exec.ExitError); ok {
-			return stdoutContents, stderrContents, errors.Annotatef(err, "Command '%s' failed with exit code %d", shellCommand, e.ProcessState.ExitCode())
-		}
-		return stdoutContents, stderrContents, errors.Trace(err)
+	warnUnboundSH.Do(func() {
+		log.Warn().Msg("SH was called outside of the goroutine running its step, so the task's output capture, " +
+			"environment, directory and retries do not apply to it; use SHContext with the step's context instead")
+	})
+	return runContext.ctx
+}
+
+// SH runs an arbitrary shell command for the step calling it, like SHContext with the step's
+// context. The step must call SH from the goroutine it runs in, otherwise the command only gets
+// the pipeline's environment and working directory, and is only killed if the workflow is cancelled.
+func SH(shellCommand string) (string, string, error) {
+	return SHContext(shContext(), shellCommand)
+}
+
+// SHContext runs an arbitrary shell command, killing it and everything it started if ctx is done first.
+// Lines of the form `key=value` that the command writes to the file named by $NANOCI_OUTPUT
+// become outputs of the task that ctx belongs to, and the command gets the environment and working
+// directory set for that task with Env, EnvFile and Dir. The trimmed output is returned even if the
+// command fails, and the error then carries the full result, see CommandResultOf.
+func SHContext(ctx context.Context, shellCommand string) (string, string, error) {
+	result, err := RunCommand(ctx, Command{Args: []string{"sh", "-c", shellCommand}})
+	if result == nil {
+		return "", "", errors.Trace(err)
 	}
-	return stdoutContents, stderrContents, nil
+	stdoutContents := strings.TrimSpace(string(result.Stdout))
+	stderrContents := strings.TrimSpace(string(result.Stderr))
+	return stdoutContents, stderrContents, errors.Trace(err)
 }
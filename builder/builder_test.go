@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func TestParallelCollectsFailures(t *testing.T) {
+	StateDir(t.TempDir())
+	r := &recorder{}
+	p := Parallel(
+		r.step("lint", errors.New("lint failed")),
+		r.step("test", errors.New("test failed")),
+		r.step("build", nil),
+		r.step("docs", errors.New("docs failed")).NoFailOnError(),
+	).MaxConcurrency(1)
+	err := callTask(context.Background(), p)
+	if r.String() != "lint test build docs" {
+		t.Errorf("ran %s, want every task", r)
+	}
+	failures, ok := errors.Cause(err).(TaskErrors)
+	if !ok || len(failures) != 2 || failures[0].Task.name != "lint" || failures[1].Task.name != "test" {
+		t.Fatalf("got error %v, want the failures of lint and test", err)
+	}
+	if p.Status() != StatusFailed {
+		t.Errorf("parallel task is %s", p.Status())
+	}
+}
+
+func TestParallelFailFast(t *testing.T) {
+	StateDir(t.TempDir())
+	cancelled := make(chan bool, 1)
+	slow := Step("slow", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			cancelled <- true
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- false
+			return nil
+		}
+	})
+	fail := Step("fail", func() error {
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("broken")
+	})
+	queued := Step("queued", noop)
+	p := Parallel(slow, fail, queued).MaxConcurrency(2).FailFast()
+	err := callTask(context.Background(), p)
+	if err == nil {
+		t.Fatal("the parallel task did not fail")
+	}
+	if !<-cancelled {
+		t.Errorf("the running task was not cancelled")
+	}
+	if queued.Status() != StatusSkipped || queued.Result().SkipReason != "a parallel task failed" {
+		t.Errorf("the queued task is %s (%s)", queued.Status(), queued.Result().SkipReason)
+	}
+}
+
+func TestParallelMaxConcurrency(t *testing.T) {
+	StateDir(t.TempDir())
+	mu := sync.Mutex{}
+	running, most, ran := 0, 0, 0
+	tasks := []*Task{}
+	for i := 0; i < 6; i++ {
+		tasks = append(tasks, Step(func() {
+			mu.Lock()
+			running++
+			ran++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}))
+	}
+	if err := callTask(context.Background(), Parallel(tasks...).MaxConcurrency(2)); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 6 || most != 2 {
+		t.Errorf("ran %d tasks with at most %d at once, want 6 with 2", ran, most)
+	}
+}
@@ -0,0 +1,272 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/otiai10/copy"
+	"github.com/rs/zerolog/log"
+)
+
+// CacheOptions declares what a task depends on and what it produces, so that it can be skipped
+// and its outputs restored from the cache when none of its inputs changed since an earlier run.
+// At least one of Inputs and Key must be set, otherwise the task could never run again once cached.
+type CacheOptions struct {
+	// Inputs are glob patterns, relative to the workspace, of the files the task reads.
+	// `**` matches any number of directories, e.g. "**/*.go".
+	Inputs []string
+	// Env are the names of the environment variables that affect the task.
+	Env []string
+	// Outputs are the files and directories, relative to the workspace, that the task produces.
+	Outputs []string
+	// Key is mixed into the hash of the inputs, change it to invalidate existing cache entries.
+	// It is required when the task has no Inputs, e.g. to cache a download by its version.
+	Key string
+}
+
+// The cache states shown in the result of a task with CacheOptions.
+const (
+	CacheHit    = "hit"
+	CacheMiss   = "miss"
+	CacheForced = "forced"
+)
+
+var cacheSettings struct {
+	dir   string
+	force bool
+}
+
+// CacheDir sets the directory cached task outputs are stored in. It defaults to $NANOCI_CACHE_DIR,
+// or a nanoci directory in the user's cache directory.
+func CacheDir(dir string) {
+	cacheSettings.dir = dir
+}
+
+// ForceRebuild makes every cached task run even if its inputs did not change, storing fresh outputs.
+// Setting $NANOCI_FORCE_REBUILD has the same effect.
+func ForceRebuild(force bool) {
+	cacheSettings.force = force
+}
+
+// Cache makes the task skip running when the cache has an entry for its current inputs,
+// restoring its outputs from the entry instead.
+func (t *Task) Cache(opts CacheOptions) *Task {
+	t.cache = &opts
+	return t
+}
+
+func cacheDir() (string, error) {
+	if cacheSettings.dir != "" {
+		return cacheSettings.dir, nil
+	}
+	if dir := os.Getenv("NANOCI_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Annotatef(err, "unable to find a cache directory, set $NANOCI_CACHE_DIR")
+	}
+	return filepath.Join(dir, "nanoci"), nil
+}
+
+// runCached runs the task through its cache, calling run only on a cache miss.
+func (t *Task) runCached(ctx context.Context, run func() error) error {
+	if len(t.cache.Inputs) == 0 && t.cache.Key == "" {
+		return errors.Errorf("cache of %s needs Inputs or a Key", t.label())
+	}
+	for _, output := range t.cache.Outputs {
+		if filepath.IsAbs(output) || strings.HasPrefix(filepath.Clean(output), "..") {
+			return errors.Errorf("cache output '%s' of %s must be relative to the workspace", output, t.label())
+		}
+	}
+	key, err := t.cacheKey(ctx)
+	if err != nil {
+		return errors.Annotatef(err, "unable to compute cache key of %s", t.label())
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	entry := filepath.Join(dir, key)
+	_, statErr := os.Stat(entry)
+	force := cacheSettings.force || os.Getenv("NANOCI_FORCE_REBUILD") != ""
+	switch {
+	case force:
+		t.setCacheStatus(CacheForced)
+	case statErr == nil:
+		err := restoreCacheEntry(entry, t.cache.Outputs)
+		if err == nil {
+			err = t.restoreTaskOutputs(entry)
+		}
+		if err == nil {
+			t.setCacheStatus(CacheHit)
+			log.Info().Msgf("Cache hit for %s, restored outputs from %s", t.label(), entry)
+			return nil
+		}
+		log.Warn().Msgf("Unable to restore cache entry for %s, running it instead: %s", t.label(), err)
+		t.setCacheStatus(CacheMiss)
+	default:
+		t.setCacheStatus(CacheMiss)
+	}
+	if err := run(); err != nil {
+		return err
+	}
+	err = storeCacheEntry(entry, t.cache.Outputs, t.taskOutputs())
+	if err != nil {
+		return errors.Annotatef(err, "unable to store outputs of %s in the cache", t.label())
+	}
+	log.Debug().Msgf("Stored outputs of %s in cache entry %s", t.label(), entry)
+	return nil
+}
+
+func (t *Task) setCacheStatus(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cacheStatus = status
+}
+
+// cacheKey hashes everything that can affect what the task produces.
+func (t *Task) cacheKey(ctx context.Context) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "nanoci-cache-v2\x00%s\x00%s\x00", t.displayName(), t.cache.Key)
+	env := append([]string{}, t.cache.Env...)
+	sort.Strings(env)
+	for _, name := range env {
+		fmt.Fprintf(h, "env\x00%s=%s\x00", name, lookupEnv(ctx, name))
+	}
+	outputs := append([]string{}, t.cache.Outputs...)
+	sort.Strings(outputs)
+	for _, output := range outputs {
+		fmt.Fprintf(h, "output\x00%s\x00", filepath.ToSlash(filepath.Clean(output)))
+	}
+	files, err := globFiles(".", t.cache.Inputs)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	for _, file := range files {
+		sum, err := hashFile(file)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		fmt.Fprintf(h, "input\x00%s\x00%s\x00", file, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the hex encoded SHA-256 hash of a file's contents.
+func hashFile(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to open '%s' for hashing", filename)
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", errors.Annotatef(err, "failed to hash '%s'", filename)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// taskOutputs returns the outputs published by the task and its descendants, by their path
+// relative to the task, "" being the task itself.
+func (t *Task) taskOutputs() map[string]map[string]string {
+	all := map[string]map[string]string{}
+	walkTasks(t, "", func(task *Task, taskPath string, depth int) {
+		if outputs := task.Outputs(); len(outputs) > 0 {
+			all[strings.TrimPrefix(strings.TrimPrefix(taskPath, t.displayName()), "/")] = outputs
+		}
+	})
+	return all
+}
+
+// restoreTaskOutputs publishes the outputs of the task and its descendants kept in a cache entry.
+func (t *Task) restoreTaskOutputs(entry string) error {
+	data, err := ioutil.ReadFile(filepath.Join(entry, "task-outputs.json"))
+	if err != nil {
+		return errors.Annotatef(err, "cache entry has no task outputs")
+	}
+	all := map[string]map[string]string{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return errors.Annotatef(err, "failed to read the task outputs in the cache")
+	}
+	walkTasks(t, "", func(task *Task, taskPath string, depth int) {
+		for key, value := range all[strings.TrimPrefix(strings.TrimPrefix(taskPath, t.displayName()), "/")] {
+			task.setOutput(key, value)
+		}
+		if task != t {
+			register(task)
+		}
+	})
+	return nil
+}
+
+// storeCacheEntry copies the outputs into a new cache entry, along with the outputs the tasks
+// published. The entry is assembled next to its final location and then renamed, so that an
+// interrupted run never leaves a partial entry behind.
+func storeCacheEntry(entry string, outputs []string, taskOutputs map[string]map[string]string) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", entry, os.Getpid())
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	data, err := json.Marshal(taskOutputs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "task-outputs.json"), data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	for _, output := range outputs {
+		if _, err := os.Stat(output); err != nil {
+			return errors.Annotatef(err, "declared output '%s' was not produced", output)
+		}
+		dest := filepath.Join(tmp, "outputs", output)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return errors.Trace(err)
+		}
+		if err := copy.Copy(output, dest); err != nil {
+			return errors.Annotatef(err, "failed to copy '%s' into the cache", output)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "outputs"), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.RemoveAll(entry); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, entry))
+}
+
+// restoreCacheEntry replaces the outputs in the workspace with the copies in a cache entry.
+func restoreCacheEntry(entry string, outputs []string) error {
+	for _, output := range outputs {
+		src := filepath.Join(entry, "outputs", output)
+		if _, err := os.Stat(src); err != nil {
+			return errors.Annotatef(err, "cache entry has no copy of '%s'", output)
+		}
+		if err := os.RemoveAll(output); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			return errors.Trace(err)
+		}
+		if err := copy.Copy(src, output); err != nil {
+			return errors.Annotatef(err, "failed to restore '%s' from the cache", output)
+		}
+	}
+	return nil
+}
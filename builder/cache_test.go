@@ -0,0 +1,138 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// inTempWorkspace runs the rest of the test in a new temporary directory.
+func inTempWorkspace(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+	return dir
+}
+
+func writeFile(t *testing.T, filename, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	inTempWorkspace(t)
+	StateDir(t.TempDir())
+	CacheDir(t.TempDir())
+	defer CacheDir("")
+	writeFile(t, "src/main.go", "package main")
+	runs := 0
+	build := func(target string) *Task {
+		return Step("build", func(ctx context.Context) error {
+			runs++
+			writeFile(t, "bin/app", "built for "+target)
+			return SetOutput(ctx, "binary", "bin/app")
+		}).Env("TARGET", target).Cache(CacheOptions{
+			Inputs:  []string{"src/**/*.go"},
+			Env:     []string{"TARGET"},
+			Outputs: []string{"bin"},
+		})
+	}
+	tests := []struct {
+		about  string
+		change func()
+		target string
+		cache  string
+		runs   int
+	}{
+		{about: "first run", target: "linux", cache: CacheMiss, runs: 1},
+		{about: "nothing changed", target: "linux", cache: CacheHit, runs: 1},
+		{about: "input changed", change: func() { writeFile(t, "src/main.go", "package main // v2") }, target: "linux", cache: CacheMiss, runs: 2},
+		{about: "input added", change: func() { writeFile(t, "src/util/util.go", "package util") }, target: "linux", cache: CacheMiss, runs: 3},
+		{about: "unrelated file changed", change: func() { writeFile(t, "README.md", "docs") }, target: "linux", cache: CacheHit, runs: 3},
+		{about: "env changed", target: "darwin", cache: CacheMiss, runs: 4},
+		{about: "back to the earlier env", target: "linux", cache: CacheHit, runs: 4},
+	}
+	for _, test := range tests {
+		if test.change != nil {
+			test.change()
+		}
+		os.RemoveAll("bin")
+		task := build(test.target)
+		if err := callTask(context.Background(), task); err != nil {
+			t.Fatalf("%s: %s", test.about, err)
+		}
+		if task.cacheStatus != test.cache || runs != test.runs {
+			t.Errorf("%s: cache %s after %d runs, want %s after %d", test.about, task.cacheStatus, runs, test.cache, test.runs)
+		}
+		data, err := ioutil.ReadFile("bin/app")
+		if err != nil || string(data) != "built for "+test.target {
+			t.Errorf("%s: output is %q, %v", test.about, data, err)
+		}
+		if binary, _ := task.Output("binary"); binary != "bin/app" {
+			t.Errorf("%s: task output is %q", test.about, binary)
+		}
+	}
+}
+
+func TestCacheKeyChangesWithKey(t *testing.T) {
+	inTempWorkspace(t)
+	keys := map[string]bool{}
+	for _, opts := range []CacheOptions{{Key: "v1"}, {Key: "v2"}, {Key: "v1", Outputs: []string{"bin"}}} {
+		key, err := Step("download", noop).Cache(opts).cacheKey(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = true
+	}
+	if len(keys) != 3 {
+		t.Errorf("got %d different keys, want 3", len(keys))
+	}
+}
+
+func TestCacheNeedsInputsOrKey(t *testing.T) {
+	inTempWorkspace(t)
+	StateDir(t.TempDir())
+	CacheDir(t.TempDir())
+	defer CacheDir("")
+	ran := false
+	task := Step("build", func(ctx context.Context) error {
+		ran = true
+		return nil
+	}).Cache(CacheOptions{Outputs: []string{"bin"}})
+	err := callTask(context.Background(), task)
+	if err == nil || !strings.Contains(err.Error(), "needs Inputs or a Key") {
+		t.Errorf("got error %v, want the missing inputs reported", err)
+	}
+	if ran {
+		t.Errorf("the task ran")
+	}
+}
+
+func TestCacheOutputOutsideWorkspace(t *testing.T) {
+	inTempWorkspace(t)
+	StateDir(t.TempDir())
+	CacheDir(t.TempDir())
+	defer CacheDir("")
+	task := Step("build", noop).Cache(CacheOptions{Key: "v1", Outputs: []string{"../bin"}})
+	err := callTask(context.Background(), task)
+	if err == nil || !strings.Contains(err.Error(), "must be relative to the workspace") {
+		t.Errorf("got error %v, want the output rejected", err)
+	}
+}
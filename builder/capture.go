@@ -0,0 +1,175 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/homelabtools/nanoci/secrets"
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// lockedBuffer is a bytes.Buffer that can be written to by several goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// commandWriter returns the writer that output of a command run by the task in ctx is copied to.
+// The output goes to w, or to the output group of the task, with secrets masked and each line
+// prefixed with the task's path and the time elapsed since the task started. It is also captured
+// for the task's result, written to the task's log file in the run directory and counts as
+// activity for its watchdogs. It must be flushed once the command has finished.
+func commandWriter(ctx context.Context, w io.Writer) *commandOutput {
+	if g, ok := ctx.Value(groupKey).(*outputGroup); ok && w != ioutil.Discard {
+		w = g
+	}
+	var tw *taskWriter
+	if t, ok := ctx.Value(taskKey).(*Task); ok {
+		tw = &taskWriter{task: t, console: w, lineStart: true}
+		w = tw
+	}
+	lines := masker.LineWriter(w)
+	return &commandOutput{Writer: activityWriter(ctx, lines), lines: lines, task: tw}
+}
+
+// commandOutput is the destination of a command's stdout or stderr.
+type commandOutput struct {
+	io.Writer
+	lines *secrets.LineWriter
+	task  *taskWriter
+}
+
+// Flush writes out the last line of output if it did not end with a newline.
+func (o *commandOutput) Flush() error {
+	err := o.lines.Flush()
+	if o.task != nil {
+		o.task.endLine()
+	}
+	return err
+}
+
+// taskWriter sends one stream of a task's output to the console, the task's log and its result.
+type taskWriter struct {
+	task      *Task
+	console   io.Writer
+	lineStart bool
+}
+
+func (w *taskWriter) Write(p []byte) (int, error) {
+	w.task.output.Write(p)
+	prefixed := &bytes.Buffer{}
+	logged := &bytes.Buffer{}
+	elapsed := formatElapsed(time.Since(w.task.startTime()))
+	name := w.task.path
+	if name == "" {
+		name = w.task.displayName()
+	}
+	// The header of a task's own output group already names it
+	g, ok := w.console.(*outputGroup)
+	ownGroup := ok && g.task == w.task
+	for rest := p; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		if w.lineStart {
+			if ownGroup {
+				fmt.Fprintf(prefixed, "%s ", elapsed)
+			} else {
+				fmt.Fprintf(prefixed, "[%s %s] ", name, elapsed)
+			}
+			fmt.Fprintf(logged, "%s ", elapsed)
+		}
+		prefixed.Write(line)
+		logged.Write(line)
+		w.lineStart = line[len(line)-1] == '\n'
+	}
+	w.task.appendLog(logged.Bytes())
+	if _, err := writeConsole(w.console, prefixed.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// endLine terminates the last line on the console and in the log if the output did not end with a
+// newline, so that it does not run into the output that follows.
+func (w *taskWriter) endLine() {
+	if w.lineStart {
+		return
+	}
+	w.lineStart = true
+	w.task.appendLog([]byte("\n"))
+	writeConsole(w.console, []byte("\n"))
+}
+
+// formatElapsed formats a duration as minutes, seconds and milliseconds, e.g. 01:02.345.
+func formatElapsed(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d.%03d", ms/60000, ms/1000%60, ms%1000)
+}
+
+// appendLog writes output to the task's log file in the run directory, which is created when the
+// task first produces output. Output produced outside of a run is not logged.
+func (t *Task) appendLog(data []byte) {
+	err := t.writeLog(data)
+	if err != nil {
+		log.Warn().Msgf("Unable to keep the log of %s: %s", t.label(), err)
+	}
+}
+
+func (t *Task) writeLog(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.logFile == nil {
+		runDir := RunDir()
+		if runDir == "" || t.logFailed {
+			return nil
+		}
+		name := t.path
+		if name == "" {
+			name = t.displayName()
+		}
+		filename := taskLogFile(runDir, name)
+		err := os.MkdirAll(filepath.Dir(filename), 0755)
+		if err == nil {
+			t.logFile, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		}
+		if err != nil {
+			t.logFailed = true
+			return errors.Trace(err)
+		}
+	}
+	_, err := t.logFile.Write(data)
+	return errors.Trace(err)
+}
+
+// closeLog closes the task's log file, once the task and its hooks are done.
+func (t *Task) closeLog() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.logFile != nil {
+		t.logFile.Close()
+		t.logFile = nil
+	}
+}
@@ -0,0 +1,154 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestRun starts a run whose directory is removed after the test.
+func startTestRun(t *testing.T) {
+	t.Helper()
+	StateDir(t.TempDir())
+	if err := startRun(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		currentRun.Lock()
+		defer currentRun.Unlock()
+		currentRun.id, currentRun.dir, currentRun.stateDir = "", "", ""
+	})
+}
+
+// taskLog returns what the task with the given path wrote to its log in the current run.
+func taskLog(t *testing.T, taskPath string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(taskLogFile(RunDir(), taskPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+var elapsedLine = regexp.MustCompile(`^\d\d:\d\d\.\d\d\d `)
+
+func TestGroupedOutput(t *testing.T) {
+	startTestRun(t)
+	attempts := 0
+	task := Step("flaky", func(ctx context.Context) error {
+		attempts++
+		exitCode := 0
+		if attempts == 1 {
+			exitCode = 1
+		}
+		script := "echo hidden; echo 'connection reset' >&2; exit " + strconv.Itoa(exitCode)
+		if _, err := RunCommand(ctx, Command{Script: script, NoTee: true}); err != nil {
+			return err
+		}
+		_, err := RunCommand(ctx, Command{Script: "echo shown"})
+		return err
+	}).Retry(RetryPolicy{MaxAttempts: 3, If: RetryOnStderr("connection reset")})
+	task.path = "root/flaky"
+	ctx, g := withOutputGroup(context.Background(), task)
+	if err := callTask(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("the task was run %d times, want 2: stderr of the first attempt was not seen", attempts)
+	}
+	grouped := g.buf.String()
+	if strings.Contains(grouped, "hidden") || strings.Contains(grouped, "connection reset") {
+		t.Errorf("output kept off the console is in the group:\n%s", grouped)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(grouped), "\n") {
+		if !elapsedLine.MatchString(line) || !strings.HasSuffix(line, " shown") {
+			t.Errorf("unexpected line in the group: %q", line)
+		}
+	}
+	logged := taskLog(t, "root/flaky")
+	for _, want := range []string{"hidden", "connection reset", "shown"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("the log does not contain %q:\n%s", want, logged)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logged), "\n") {
+		if !elapsedLine.MatchString(line) {
+			t.Errorf("line of the log has no timestamp: %q", line)
+		}
+	}
+}
+
+func TestPrefixedOutput(t *testing.T) {
+	startTestRun(t)
+	MaskValue("s3cr3t")
+	task := Step("build (GOOS=linux)", noop)
+	task.path = "root/build (GOOS=linux)"
+	task.begin()
+	console := &lockedBuffer{}
+	out := commandWriter(context.WithValue(context.Background(), taskKey, task), console)
+	for _, chunk := range []string{"comp", "iling\ntoken s3cr3t\n", "no newline"} {
+		if _, err := out.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	prefixed := regexp.MustCompile(`^\[root/build \(GOOS=linux\) \d\d:\d\d\.\d\d\d\] `)
+	lines := strings.Split(strings.TrimSuffix(console.String(), "\n"), "\n")
+	want := []string{"compiling", "token ***", "no newline"}
+	if len(lines) != len(want) {
+		t.Fatalf("got console output %q", console.String())
+	}
+	for i, line := range lines {
+		if !prefixed.MatchString(line) || prefixed.ReplaceAllString(line, "") != want[i] {
+			t.Errorf("got line %q, want %q with a prefix", line, want[i])
+		}
+	}
+	logged := strings.Split(strings.TrimSuffix(taskLog(t, task.path), "\n"), "\n")
+	for i, line := range logged {
+		if i >= len(want) || !elapsedLine.MatchString(line) || elapsedLine.ReplaceAllString(line, "") != want[i] {
+			t.Errorf("got line %q in the log", line)
+		}
+	}
+	if output := task.Result().Output; output != "compiling\ntoken ***\nno newline" {
+		t.Errorf("got output %q in the result", output)
+	}
+}
+
+func TestTaskLogFile(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"root/build", "run/logs/root/build.log"},
+		{"root/build (GOOS=linux, GOARCH=arm64)", "run/logs/root/build__GOOS=linux__GOARCH=arm64_.log"},
+		{"root/step@main.go:12", "run/logs/root/step_main.go_12.log"},
+	}
+	for _, test := range tests {
+		if got := filepath.ToSlash(taskLogFile("run", test.path)); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestFormatElapsed(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "00:00.000"},
+		{1234 * time.Millisecond, "00:01.234"},
+		{62*time.Second + 5*time.Millisecond, "01:02.005"},
+		{100 * time.Minute, "100:00.000"},
+	}
+	for _, test := range tests {
+		if got := formatElapsed(test.d); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.d, got, test.want)
+		}
+	}
+}
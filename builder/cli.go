@@ -0,0 +1,248 @@
+package builder
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog"
+)
+
+// cli holds the command line options parsed by BuilderMain.
+var cli struct {
+	list     bool
+	plan     string
+	graph    string
+	only     stringList
+	skip     stringList
+	params   map[string]string
+	output   string
+	noNotify bool
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// paramFlag is a repeatable key=value flag.
+type paramFlag map[string]string
+
+func (p paramFlag) String() string {
+	return ""
+}
+
+func (p paramFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return errors.Errorf("parameter '%s' must be of the form key=value", value)
+	}
+	p[value[:i]] = value[i+1:]
+	return nil
+}
+
+// parseArgs parses the builder's command line options into cli and the pipeline settings.
+func parseArgs(args []string) error {
+	flags := flag.NewFlagSet(path.Base(os.Args[0]), flag.ContinueOnError)
+	cli.params = map[string]string{}
+	flags.BoolVar(&cli.list, "list", false, "print the task tree and exit")
+	flags.StringVar(&cli.plan, "plan", "", "print what would run, as 'text' or 'json', and exit without running anything")
+	dryRun := flags.Bool("dry-run", false, "same as --plan text")
+	flags.StringVar(&cli.graph, "graph", "", "print the pipeline as a 'dot' or 'mermaid' diagram and exit")
+	flags.Var(&cli.only, "only", "run only this task, by name or path, along with its dependencies (repeatable)")
+	flags.Var(&cli.skip, "skip", "skip this task, by name or path (repeatable)")
+	flags.Var(paramFlag(cli.params), "param", "set a parameter readable with builder.Param, as key=value (repeatable)")
+	flags.StringVar(&cli.output, "output", "prefixed", "how parallel tasks show their output: 'prefixed' lines as they come, or 'grouped' in one block per task")
+	flags.BoolVar(&cli.noNotify, "no-notify", false, "do not send notifications when the run has finished")
+	logLevel := flags.String("log-level", "info", "log level: trace, debug, info, warn or error")
+	timeout := flags.Duration("timeout", 0, "fail the pipeline if it runs longer than this")
+	hookTimeout := flags.Duration("hook-timeout", 0, "stop the hooks run after a task if they run longer than this (default 10m)")
+	forceRebuild := flags.Bool("force-rebuild", false, "run cached tasks even if their inputs did not change")
+	stateDir := flags.String("state-dir", "", "directory runs are recorded in (default $NANOCI_STATE_DIR or .nanoci)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *dryRun && cli.plan == "" {
+		cli.plan = "text"
+	}
+	if cli.plan != "" && cli.plan != "text" && cli.plan != "json" {
+		return errors.Errorf("--plan must be 'text' or 'json', not '%s'", cli.plan)
+	}
+	if cli.graph != "" && cli.graph != "dot" && cli.graph != "mermaid" {
+		return errors.Errorf("--graph must be 'dot' or 'mermaid', not '%s'", cli.graph)
+	}
+	if cli.output != "prefixed" && cli.output != "grouped" {
+		return errors.Errorf("--output must be 'prefixed' or 'grouped', not '%s'", cli.output)
+	}
+	if flags.NArg() > 0 {
+		return errors.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		return errors.Annotatef(err, "invalid log level")
+	}
+	zerolog.SetGlobalLevel(level)
+	if *timeout > 0 {
+		PipelineTimeout(*timeout)
+	}
+	if *hookTimeout > 0 {
+		HookTimeout(*hookTimeout)
+	}
+	if *forceRebuild {
+		ForceRebuild(true)
+	}
+	if *stateDir != "" {
+		StateDir(*stateDir)
+	}
+	return nil
+}
+
+// Param returns the value of a parameter set with --param, or an empty string if it was not set.
+func Param(name string) string {
+	return cli.params[name]
+}
+
+// Params returns all parameters set with --param.
+func Params() Args {
+	params := Args{}
+	for k, v := range cli.params {
+		params[k] = v
+	}
+	return params
+}
+
+// walkTasks calls fn for t and each of its descendants along with their paths, depth first.
+func walkTasks(t *Task, parentPath string, fn func(t *Task, taskPath string, depth int)) {
+	var walk func(t *Task, parentPath string, depth int)
+	walk = func(t *Task, parentPath string, depth int) {
+		taskPath := t.displayName()
+		if parentPath != "" {
+			taskPath = parentPath + "/" + taskPath
+		}
+		fn(t, taskPath, depth)
+		for _, child := range t.subtasks() {
+			walk(child, taskPath, depth+1)
+		}
+	}
+	walk(t, parentPath, 0)
+}
+
+// matchesTask reports whether a --only or --skip pattern refers to a task. Patterns are matched
+// against the task's name and its path, with or without the leading "root/", and may contain wildcards.
+func matchesTask(pattern string, t *Task, taskPath string) bool {
+	candidates := []string{t.displayName(), taskPath, strings.TrimPrefix(taskPath, "root/")}
+	for _, candidate := range candidates {
+		if ok, _ := path.Match(pattern, candidate); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// findTasks returns the tasks below root that match the pattern.
+func findTasks(root *Task, pattern string) []*Task {
+	found := []*Task{}
+	walkTasks(root, "", func(t *Task, taskPath string, depth int) {
+		if matchesTask(pattern, t, taskPath) {
+			found = append(found, t)
+		}
+	})
+	return found
+}
+
+// applySelection marks the tasks that --only and --skip exclude from the run.
+func applySelection(root *Task) error {
+	if len(cli.only) > 0 {
+		selected := map[*Task]bool{}
+		var selectTask func(t *Task)
+		selectTask = func(t *Task) {
+			if selected[t] {
+				return
+			}
+			selected[t] = true
+			for _, child := range t.subtasks() {
+				selectTask(child)
+			}
+			for _, dep := range t.dependsOn {
+				selectTask(dep)
+			}
+		}
+		for _, pattern := range cli.only {
+			found := findTasks(root, pattern)
+			if len(found) == 0 {
+				return errors.NotFoundf("task matching --only '%s'", pattern)
+			}
+			for _, t := range found {
+				selectTask(t)
+			}
+		}
+		// A task that contains a selected task must run as well, for the selected task to run
+		var markAncestors func(t *Task) bool
+		markAncestors = func(t *Task) bool {
+			contains := selected[t]
+			for _, child := range t.subtasks() {
+				if markAncestors(child) {
+					contains = true
+				}
+			}
+			if contains {
+				selected[t] = true
+			}
+			return contains
+		}
+		markAncestors(root)
+		walkTasks(root, "", func(t *Task, taskPath string, depth int) {
+			if !selected[t] {
+				t.deselect("not selected by --only")
+			}
+		})
+	}
+	for _, pattern := range cli.skip {
+		found := findTasks(root, pattern)
+		if len(found) == 0 {
+			return errors.NotFoundf("task matching --skip '%s'", pattern)
+		}
+		for _, t := range found {
+			t.deselect(fmt.Sprintf("skipped by --skip '%s'", pattern))
+		}
+	}
+	return nil
+}
+
+func (t *Task) deselect(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deselected = reason
+}
+
+func (t *Task) deselectedReason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.deselected
+}
+
+// printTaskTree writes the tree of tasks below root, one per line.
+func printTaskTree(w io.Writer, root *Task) {
+	walkTasks(root, "", func(t *Task, taskPath string, depth int) {
+		line := fmt.Sprintf("%s%s [%s]", strings.Repeat("  ", depth), t.displayName(), t.kind)
+		if len(t.dependsOn) > 0 {
+			line += " depends on " + describeTasks(t.dependsOn)
+		}
+		if t.deselected != "" {
+			line += " (" + t.deselected + ")"
+		}
+		fmt.Fprintln(w, line)
+	})
+}
@@ -0,0 +1,127 @@
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog"
+)
+
+// resetCLI restores the command line options after the test.
+func resetCLI(t *testing.T) {
+	level := zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		cli.list, cli.plan, cli.graph, cli.output, cli.noNotify = false, "", "", "", false
+		cli.only, cli.skip, cli.params = nil, nil, nil
+		zerolog.SetGlobalLevel(level)
+	})
+}
+
+func TestParseArgs(t *testing.T) {
+	resetCLI(t)
+	err := parseArgs([]string{"--dry-run", "--only", "build", "--only", "root/test", "--skip", "lint", "--param", "version=1.2=3", "--output", "grouped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cli.plan != "text" || cli.only.String() != "build,root/test" || cli.skip.String() != "lint" || cli.output != "grouped" {
+		t.Errorf("got plan %q, only %s, skip %s, output %s", cli.plan, cli.only.String(), cli.skip.String(), cli.output)
+	}
+	if Param("version") != "1.2=3" || Param("missing") != "" || len(Params()) != 1 {
+		t.Errorf("got params %v", Params())
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	resetCLI(t)
+	tests := []struct {
+		args  []string
+		error string
+	}{
+		{[]string{"--plan", "xml"}, "--plan must be 'text' or 'json', not 'xml'"},
+		{[]string{"--graph", "svg"}, "--graph must be 'dot' or 'mermaid', not 'svg'"},
+		{[]string{"--output", "fancy"}, "--output must be 'prefixed' or 'grouped', not 'fancy'"},
+		{[]string{"--param", "version"}, "parameter 'version' must be of the form key=value"},
+		{[]string{"--log-level", "loud"}, "invalid log level"},
+		{[]string{"build"}, "unexpected arguments: build"},
+	}
+	for _, test := range tests {
+		err := parseArgs(test.args)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%v: got error %v, want %q", test.args, err, test.error)
+		}
+	}
+}
+
+func TestApplySelection(t *testing.T) {
+	resetCLI(t)
+	tests := []struct {
+		only, skip []string
+		deselected string
+		error      string
+	}{
+		{only: []string{"test"}, deselected: "web deploy"},
+		{only: []string{"build"}, deselected: "test deploy"},
+		{only: []string{"build/w*"}, deselected: "api test deploy"},
+		{only: []string{"root/deploy", "web"}, deselected: "api test"},
+		{skip: []string{"deploy"}, deselected: "deploy"},
+		{only: []string{"build"}, skip: []string{"web"}, deselected: "web test deploy"},
+		{only: []string{"release"}, error: "task matching --only 'release' not found"},
+		{skip: []string{"release"}, error: "task matching --skip 'release' not found"},
+	}
+	for _, test := range tests {
+		api := Step("api", noop)
+		root := Stage("root",
+			Stage("build", api, Step("web", noop)),
+			Step("test", noop).DependsOn(api),
+			Step("deploy", noop),
+		)
+		cli.only, cli.skip = test.only, test.skip
+		err := applySelection(root)
+		if test.error != "" {
+			if err == nil || err.Error() != test.error || !errors.IsNotFound(err) {
+				t.Errorf("only %v, skip %v: got error %v, want %q", test.only, test.skip, err, test.error)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		deselected := []string{}
+		walkTasks(root, "", func(t *Task, taskPath string, depth int) {
+			if t.deselectedReason() != "" {
+				deselected = append(deselected, t.name)
+			}
+		})
+		if got := strings.Join(deselected, " "); got != test.deselected {
+			t.Errorf("only %v, skip %v: got %q deselected, want %q", test.only, test.skip, got, test.deselected)
+		}
+	}
+}
+
+func TestOnlyRunsSelectedTasks(t *testing.T) {
+	resetCLI(t)
+	StateDir(t.TempDir())
+	r := &recorder{}
+	api := r.step("api", nil)
+	root := Stage("root",
+		Stage("build", api, r.step("web", nil)),
+		r.step("test", nil).DependsOn(api),
+		r.step("deploy", nil),
+	)
+	cli.only = []string{"test"}
+	if err := applySelection(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != "api test" {
+		t.Errorf("ran %s, want api test", r)
+	}
+	deploy := root.children[2]
+	if deploy.Status() != StatusSkipped || deploy.Result().SkipReason != "not selected by --only" {
+		t.Errorf("deploy is %s: %s", deploy.Status(), deploy.Result().SkipReason)
+	}
+}
@@ -0,0 +1,160 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/homelabtools/nanoci/proc"
+	"github.com/juju/errors"
+)
+
+// strictMode is prepended to scripts run by RunCommand. Shells without pipefail, like dash, only get `set -eu`.
+const strictMode = "set -eu\nif (set -o pipefail) 2>/dev/null; then set -o pipefail; fi\n"
+
+// Command describes a command to run with RunCommand.
+type Command struct {
+	// Args are the program and its arguments, which are run directly without a shell.
+	Args []string
+	// Script is a shell script to run instead of Args, in strict mode (`set -euo pipefail`).
+	Script string
+	// Shell runs Script, it defaults to bash.
+	Shell string
+	// Stdin is the input of the command, by default it reads nothing.
+	Stdin io.Reader
+	// Env holds variables set on top of the environment of the task, see Env.
+	Env map[string]string
+	// Dir is the working directory, relative to the workspace root. It defaults to that of the task, see Dir.
+	Dir string
+	// NoTee keeps the output off the console. It is still captured in the result and the task's log.
+	NoTee bool
+}
+
+// String returns the command line, or the script, that the command runs.
+func (c Command) String() string {
+	if c.Script != "" {
+		return c.Script
+	}
+	return strings.Join(c.Args, " ")
+}
+
+// CommandResult describes a command that ran to completion.
+type CommandResult struct {
+	Command  Command
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+	Duration time.Duration
+	Usage    ResourceUsage
+}
+
+// ResourceUsage is the CPU time and memory used by a command and the processes it waited for.
+type ResourceUsage struct {
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSS is the peak resident set size in bytes, 0 where it is not known.
+	MaxRSS int64
+}
+
+// CommandError is returned by RunCommand when a command exits with a non-zero code or is killed.
+type CommandError struct {
+	Result *CommandResult
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	if e.Result.ExitCode < 0 {
+		return fmt.Sprintf("command '%s' failed: %s", e.Result.Command, e.Err)
+	}
+	return fmt.Sprintf("command '%s' failed with exit code %d", e.Result.Command, e.Result.ExitCode)
+}
+
+// CommandResultOf returns the result carried by an error returned from RunCommand, SH or SHContext.
+func CommandResultOf(err error) (*CommandResult, bool) {
+	if e, ok := errors.Cause(err).(*CommandError); ok {
+		return e.Result, true
+	}
+	return nil, false
+}
+
+// RunCommand runs a command on behalf of the task that ctx belongs to, killing it and everything it
+// started if ctx is done first. Its output is shown on the console, unless NoTee is set, and captured
+// in the task's log. Like SHContext, it gets the environment and working directory of the task, and
+// `key=value` lines written to the file named by $NANOCI_OUTPUT become outputs of the task.
+// If the command exits with a non-zero code the error is a *CommandError, which carries the result.
+func RunCommand(ctx context.Context, c Command) (*CommandResult, error) {
+	args := c.Args
+	if c.Script != "" {
+		shell := c.Shell
+		if shell == "" {
+			shell = "bash"
+		}
+		args = []string{shell, "-c", strictMode + c.Script}
+	}
+	if len(args) == 0 {
+		return nil, errors.New("command has neither arguments nor a script")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	out, err := newOutputFile(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer out.remove()
+	env, err := commandEnv(ctx, out.env()...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cmd.Env = mergeEnv(env, c.Env)
+	cmd.Dir = workDir(ctx)
+	if c.Dir != "" {
+		if cmd.Dir, err = resolveDir(c.Dir); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	cmd.Stdin = c.Stdin
+	var console, consoleErr io.Writer = os.Stdout, os.Stderr
+	if c.NoTee {
+		console, consoleErr = ioutil.Discard, ioutil.Discard
+	}
+	stdoutBuf := &bytes.Buffer{}
+	stderrBuf := &bytes.Buffer{}
+	stdout := commandWriter(ctx, console)
+	stderr := commandWriter(ctx, consoleErr)
+	cmd.Stdout = io.MultiWriter(stdoutBuf, stdout)
+	cmd.Stderr = recordStderr(ctx, io.MultiWriter(stderrBuf, stderr))
+	start := time.Now()
+	p, err := proc.Start(ctx, cmd)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to start command '%s'", c)
+	}
+	// Wait returns once the output has been copied, which the flushes rely on
+	err = p.Wait()
+	stdout.Flush()
+	stderr.Flush()
+	result := &CommandResult{
+		Command:  c,
+		ExitCode: -1,
+		Stdout:   stdoutBuf.Bytes(),
+		Stderr:   stderrBuf.Bytes(),
+		Duration: time.Since(start),
+	}
+	if state := cmd.ProcessState; state != nil {
+		result.ExitCode = state.ExitCode()
+		result.Usage = ResourceUsage{UserTime: state.UserTime(), SystemTime: state.SystemTime(), MaxRSS: maxRSS(state)}
+	}
+	if out != nil {
+		if collectErr := out.collect(); err == nil && collectErr != nil {
+			return result, errors.Trace(collectErr)
+		}
+	}
+	if err != nil {
+		return result, &CommandError{Result: result, Err: err}
+	}
+	return result, nil
+}
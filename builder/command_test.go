@@ -0,0 +1,78 @@
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		command        Command
+		stdout, stderr string
+		exitCode       int
+		error          string
+	}{
+		{command: Command{Args: []string{"echo", "hello world"}}, stdout: "hello world\n"},
+		{command: Command{Args: []string{"cat"}, Stdin: strings.NewReader("piped")}, stdout: "piped"},
+		{command: Command{Args: []string{"cat"}}, stdout: ""},
+		{command: Command{Script: "echo $GREETING; echo oops >&2", Env: map[string]string{"GREETING": "hi"}}, stdout: "hi\n", stderr: "oops\n"},
+		{command: Command{Script: "exit 3"}, exitCode: 3, error: "command 'exit 3' failed with exit code 3"},
+		// Scripts run in strict mode
+		{command: Command{Script: "false | true; echo unreachable"}, exitCode: 1, error: "failed with exit code 1"},
+		{command: Command{Script: "{ echo $UNSET_VARIABLE; } 2>/dev/null"}, exitCode: 1, error: "failed with exit code 1"},
+		{command: Command{Script: "echo dash", Shell: "sh"}, stdout: "dash\n"},
+	}
+	for _, test := range tests {
+		test.command.NoTee = true
+		result, err := RunCommand(context.Background(), test.command)
+		if result == nil {
+			t.Errorf("%s: got no result, error %v", test.command, err)
+			continue
+		}
+		if string(result.Stdout) != test.stdout || string(result.Stderr) != test.stderr || result.ExitCode != test.exitCode {
+			t.Errorf("%s: got %q, %q, exit code %d", test.command, result.Stdout, result.Stderr, result.ExitCode)
+		}
+		if test.error == "" && err != nil {
+			t.Errorf("%s: got error %v", test.command, err)
+		}
+		if test.error != "" {
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("%s: got error %v, want %q", test.command, err, test.error)
+			}
+			if carried, ok := CommandResultOf(err); !ok || carried != result {
+				t.Errorf("%s: the error does not carry the result", test.command)
+			}
+		}
+	}
+}
+
+func TestRunCommandErrors(t *testing.T) {
+	if _, err := RunCommand(context.Background(), Command{}); err == nil || err.Error() != "command has neither arguments nor a script" {
+		t.Errorf("got error %v for an empty command", err)
+	}
+	result, err := RunCommand(context.Background(), Command{Args: []string{"nanoci-no-such-program"}})
+	if result != nil || err == nil || !strings.Contains(err.Error(), "unable to start command 'nanoci-no-such-program'") {
+		t.Errorf("got %v, %v for a missing program", result, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err = RunCommand(ctx, Command{Args: []string{"sleep", "30"}})
+	if result == nil || result.ExitCode != -1 || !strings.Contains(err.Error(), "command 'sleep 30' failed: ") {
+		t.Errorf("got %v, %v for a killed command", result, err)
+	}
+	if result != nil && result.Duration > 5*time.Second {
+		t.Errorf("the command was not killed, it ran for %s", result.Duration)
+	}
+}
+
+func TestSHContext(t *testing.T) {
+	stdout, stderr, err := SHContext(context.Background(), "echo '  out  '; echo err >&2; exit 2")
+	if stdout != "out" || stderr != "err" {
+		t.Errorf("got %q, %q", stdout, stderr)
+	}
+	if result, ok := CommandResultOf(err); !ok || result.ExitCode != 2 {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Condition decides whether a task should run. Conditions are checked right before the task
+// would start, so they can depend on the outcome of tasks that ran earlier.
+type Condition struct {
+	description string
+	check       func() bool
+	// dynamic conditions depend on the outcome of other tasks, so they cannot be known before the run.
+	dynamic bool
+}
+
+// NewCondition creates a condition from an arbitrary check. The description is used to explain
+// why a task was skipped.
+func NewCondition(description string, check func() bool) Condition {
+	return Condition{description: description, check: check}
+}
+
+func (c Condition) String() string {
+	return c.description
+}
+
+// When makes the task run only if all of the conditions hold. Otherwise it is skipped.
+func (t *Task) When(conditions ...Condition) *Task {
+	t.conditions = append(t.conditions, conditions...)
+	return t
+}
+
+// Unless skips the task if any of the conditions hold.
+func (t *Task) Unless(conditions ...Condition) *Task {
+	for _, c := range conditions {
+		c := c
+		t.conditions = append(t.conditions, Condition{
+			description: "not " + c.description,
+			check: func() bool {
+				return !c.check()
+			},
+			dynamic: c.dynamic,
+		})
+	}
+	return t
+}
+
+// shouldRun checks the task's conditions, returning the reason to skip it if any of them fails.
+func (t *Task) shouldRun() (bool, string) {
+	for _, c := range t.conditions {
+		if !c.check() {
+			return false, fmt.Sprintf("condition '%s' is not met", c.description)
+		}
+	}
+	return true, ""
+}
+
+// OnBranch holds when the branch being built matches one of the patterns, e.g. "main" or "release/*".
+func OnBranch(patterns ...string) Condition {
+	return NewCondition("branch is "+strings.Join(patterns, " or "), func() bool {
+		branch := CurrentBranch()
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, branch); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// EnvSet holds when the environment variable is set to a non-empty value.
+func EnvSet(name string) Condition {
+	return NewCondition(fmt.Sprintf("$%s is set", name), func() bool {
+		return os.Getenv(name) != ""
+	})
+}
+
+// EnvEquals holds when the environment variable has exactly the given value.
+func EnvEquals(name, value string) Condition {
+	return NewCondition(fmt.Sprintf("$%s is '%s'", name, value), func() bool {
+		return os.Getenv(name) == value
+	})
+}
+
+// Succeeded holds when all of the tasks have finished without failing the pipeline.
+func Succeeded(tasks ...*Task) Condition {
+	c := NewCondition(describeTasks(tasks)+" succeeded", func() bool {
+		for _, t := range tasks {
+			if !t.succeeded() {
+				return false
+			}
+		}
+		return true
+	})
+	c.dynamic = true
+	return c
+}
+
+// Failed holds when any of the tasks has failed, including failures allowed with NoFailOnError.
+func Failed(tasks ...*Task) Condition {
+	c := NewCondition(describeTasks(tasks)+" failed", func() bool {
+		for _, t := range tasks {
+			status := t.Status()
+			if status == StatusFailed || status == StatusAllowedFailure {
+				return true
+			}
+		}
+		return false
+	})
+	c.dynamic = true
+	return c
+}
+
+func describeTasks(tasks []*Task) string {
+	labels := []string{}
+	for _, t := range tasks {
+		labels = append(labels, t.label())
+	}
+	return strings.Join(labels, ", ")
+}
+
+// branchEnvVars are the environment variables that CI systems use to pass the branch being built.
+var branchEnvVars = []string{"NANOCI_BRANCH", "GITHUB_REF_NAME", "DRONE_BRANCH", "CI_COMMIT_BRANCH", "BRANCH_NAME"}
+
+// CurrentBranch returns the branch being built. It is taken from the environment variables set by
+// common CI systems, or from git if none of them are set.
+func CurrentBranch() string {
+	for _, name := range branchEnvVars {
+		if branch := os.Getenv(name); branch != "" {
+			return branch
+		}
+	}
+	out, err := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,77 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestConditions(t *testing.T) {
+	defer os.Unsetenv("NANOCI_BRANCH")
+	defer os.Unsetenv("NANOCI_TEST_DEPLOY")
+	tests := []struct {
+		branch, deploy string
+		condition      Condition
+		want           bool
+	}{
+		{branch: "main", condition: OnBranch("main", "release/*"), want: true},
+		{branch: "release/1.2", condition: OnBranch("main", "release/*"), want: true},
+		{branch: "feature/x", condition: OnBranch("main", "release/*"), want: false},
+		{deploy: "staging", condition: EnvSet("NANOCI_TEST_DEPLOY"), want: true},
+		{condition: EnvSet("NANOCI_TEST_DEPLOY"), want: false},
+		{deploy: "staging", condition: EnvEquals("NANOCI_TEST_DEPLOY", "staging"), want: true},
+		{deploy: "production", condition: EnvEquals("NANOCI_TEST_DEPLOY", "staging"), want: false},
+		{condition: NewCondition("always", func() bool { return true }), want: true},
+	}
+	for _, test := range tests {
+		os.Setenv("NANOCI_BRANCH", test.branch)
+		os.Setenv("NANOCI_TEST_DEPLOY", test.deploy)
+		when, reason := Step(noop).When(test.condition).shouldRun()
+		if when != test.want {
+			t.Errorf("%s with branch %q and deploy %q: got %v (%s)", test.condition, test.branch, test.deploy, when, reason)
+		}
+		unless, _ := Step(noop).Unless(test.condition).shouldRun()
+		if unless == test.want {
+			t.Errorf("not %s with branch %q and deploy %q: got %v", test.condition, test.branch, test.deploy, unless)
+		}
+	}
+}
+
+func TestConditionSkipReason(t *testing.T) {
+	task := Step(noop).When(EnvSet("NANOCI_TEST_UNSET")).Unless(NewCondition("it is Friday", func() bool { return true }))
+	if ok, reason := task.shouldRun(); ok || reason != "condition '$NANOCI_TEST_UNSET is set' is not met" {
+		t.Errorf("got %v (%s)", ok, reason)
+	}
+	task = Step(noop).Unless(NewCondition("it is Friday", func() bool { return true }))
+	if ok, reason := task.shouldRun(); ok || reason != "condition 'not it is Friday' is not met" {
+		t.Errorf("got %v (%s)", ok, reason)
+	}
+}
+
+func TestStatusConditions(t *testing.T) {
+	StateDir(t.TempDir())
+	r := &recorder{}
+	// An allowed failure both failed and did not fail the pipeline
+	build := r.step("build", errors.New("broken")).NoFailOnError()
+	lint := r.step("lint", nil).When(EnvSet("NANOCI_TEST_UNSET"))
+	publish := r.step("publish", nil).When(Succeeded(lint))
+	root := Stage("root",
+		build,
+		lint,
+		r.step("deploy", nil).When(Succeeded(build)),
+		r.step("report", nil).When(Failed(build)),
+		publish,
+	)
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != "build deploy report" {
+		t.Errorf("ran %s, want build deploy report", r)
+	}
+	result := publish.Result()
+	if result.Status != StatusSkipped || result.SkipReason != "condition ''lint' succeeded' is not met" {
+		t.Errorf("publish is %s (%s)", result.Status, result.SkipReason)
+	}
+}
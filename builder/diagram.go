@@ -0,0 +1,150 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// statusColors are the fill colours of tasks in diagrams coloured by the outcome of a run.
+var statusColors = map[Status]string{
+	StatusPending:        "#ffffff",
+	StatusRunning:        "#fff3a0",
+	StatusSuccess:        "#a6e3a1",
+	StatusFailed:         "#f38ba8",
+	StatusSkipped:        "#d9d9d9",
+	StatusAllowedFailure: "#fab387",
+}
+
+// diagram assigns node IDs to results and works out the edges between them, for rendering
+// the structure of a pipeline in a graph description language.
+type diagram struct {
+	ids    map[*Result]string
+	byPath map[string]*Result
+	edges  [][2]*Result
+}
+
+func newDiagram(root *Result) *diagram {
+	d := &diagram{ids: map[*Result]string{}, byPath: map[string]*Result{}}
+	root.Walk(func(r *Result, depth int) {
+		d.ids[r] = fmt.Sprintf("n%d", len(d.ids))
+		d.byPath[r.Path] = r
+	})
+	root.Walk(func(r *Result, depth int) {
+		// The children of a stage run one after another
+		if r.Kind == "stage" {
+			for i := 1; i < len(r.Children); i++ {
+				d.edges = append(d.edges, [2]*Result{r.Children[i-1], r.Children[i]})
+			}
+		}
+		if from, ok := d.byPath[r.After]; ok && r.After != "" {
+			d.edges = append(d.edges, [2]*Result{from, r})
+		}
+		for _, dep := range r.DependsOn {
+			if from, ok := d.byPath[dep]; ok {
+				d.edges = append(d.edges, [2]*Result{from, r})
+			}
+		}
+	})
+	return d
+}
+
+// anchor returns the ID of a node inside r, used to attach edges to clusters in DOT.
+func (d *diagram) anchor(r *Result) string {
+	for len(r.Children) > 0 {
+		r = r.Children[0]
+	}
+	return d.ids[r]
+}
+
+// WriteDOT writes the structure of the run as a Graphviz DOT digraph. Tasks containing other tasks
+// become clusters, and edges show the order of stages and the dependencies between tasks.
+// If colored is set, tasks are filled according to their status.
+func (r *Result) WriteDOT(w io.Writer, colored bool) error {
+	d := newDiagram(r)
+	b := &strings.Builder{}
+	b.WriteString("digraph pipeline {\n")
+	b.WriteString("  compound=true;\n  rankdir=LR;\n  node [shape=box, style=\"rounded,filled\", fillcolor=\"#ffffff\"];\n")
+	var node func(r *Result, indent string)
+	node = func(r *Result, indent string) {
+		id := d.ids[r]
+		if len(r.Children) == 0 {
+			fmt.Fprintf(b, "%s%s [label=%s", indent, id, dotQuote(r.Name))
+			if colored {
+				fmt.Fprintf(b, ", fillcolor=%s", dotQuote(statusColors[r.Status]))
+			}
+			b.WriteString("];\n")
+			return
+		}
+		fmt.Fprintf(b, "%ssubgraph cluster_%s {\n", indent, id)
+		fmt.Fprintf(b, "%s  label=%s;\n", indent, dotQuote(fmt.Sprintf("%s [%s]", r.Name, r.Kind)))
+		if colored {
+			fmt.Fprintf(b, "%s  style=filled;\n%s  fillcolor=%s;\n", indent, indent, dotQuote(statusColors[r.Status]))
+		}
+		for _, child := range r.Children {
+			node(child, indent+"  ")
+		}
+		fmt.Fprintf(b, "%s}\n", indent)
+	}
+	node(r, "  ")
+	for _, edge := range d.edges {
+		from, to := edge[0], edge[1]
+		attrs := []string{}
+		if len(from.Children) > 0 {
+			attrs = append(attrs, "ltail=cluster_"+d.ids[from])
+		}
+		if len(to.Children) > 0 {
+			attrs = append(attrs, "lhead=cluster_"+d.ids[to])
+		}
+		fmt.Fprintf(b, "  %s -> %s", d.anchor(from), d.anchor(to))
+		if len(attrs) > 0 {
+			fmt.Fprintf(b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return errors.Trace(err)
+}
+
+// WriteMermaid writes the structure of the run as a Mermaid flowchart, for embedding in
+// Markdown. If colored is set, tasks are filled according to their status.
+func (r *Result) WriteMermaid(w io.Writer, colored bool) error {
+	d := newDiagram(r)
+	b := &strings.Builder{}
+	b.WriteString("flowchart LR\n")
+	var node func(r *Result, indent string)
+	node = func(r *Result, indent string) {
+		id := d.ids[r]
+		if len(r.Children) == 0 {
+			fmt.Fprintf(b, "%s%s[%s]\n", indent, id, mermaidQuote(r.Name))
+			return
+		}
+		fmt.Fprintf(b, "%ssubgraph %s [%s]\n", indent, id, mermaidQuote(fmt.Sprintf("%s [%s]", r.Name, r.Kind)))
+		for _, child := range r.Children {
+			node(child, indent+"  ")
+		}
+		fmt.Fprintf(b, "%send\n", indent)
+	}
+	node(r, "  ")
+	for _, edge := range d.edges {
+		fmt.Fprintf(b, "  %s --> %s\n", d.ids[edge[0]], d.ids[edge[1]])
+	}
+	if colored {
+		r.Walk(func(r *Result, depth int) {
+			fmt.Fprintf(b, "  style %s fill:%s\n", d.ids[r], statusColors[r.Status])
+		})
+	}
+	_, err := io.WriteString(w, b.String())
+	return errors.Trace(err)
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func mermaidQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, "#quot;", -1) + `"`
+}
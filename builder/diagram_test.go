@@ -0,0 +1,74 @@
+package builder
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testRunResult is the result of a stage that built, ran two checks in parallel and deployed.
+func testRunResult() *Result {
+	return &Result{Name: "root", Path: "root", Kind: "stage", Status: StatusFailed, Children: []*Result{
+		{Name: "build", Path: "root/build", Kind: "step", Status: StatusSuccess},
+		{Name: "checks", Path: "root/checks", Kind: "parallel", Status: StatusFailed, Children: []*Result{
+			{Name: "lint", Path: "root/checks/lint", Kind: "step", Status: StatusFailed},
+			{Name: `say "hi"`, Path: `root/checks/say "hi"`, Kind: "step", Status: StatusSuccess},
+		}},
+		{Name: "deploy", Path: "root/deploy", Kind: "step", Status: StatusSkipped, DependsOn: []string{"root/checks/lint"}},
+	}}
+}
+
+func TestWriteDOT(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := testRunResult().WriteDOT(out, true); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph pipeline {
+  compound=true;
+  rankdir=LR;
+  node [shape=box, style="rounded,filled", fillcolor="#ffffff"];
+  subgraph cluster_n0 {
+    label="root [stage]";
+    style=filled;
+    fillcolor="#f38ba8";
+    n1 [label="build", fillcolor="#a6e3a1"];
+    subgraph cluster_n2 {
+      label="checks [parallel]";
+      style=filled;
+      fillcolor="#f38ba8";
+      n3 [label="lint", fillcolor="#f38ba8"];
+      n4 [label="say \"hi\"", fillcolor="#a6e3a1"];
+    }
+    n5 [label="deploy", fillcolor="#d9d9d9"];
+  }
+  n1 -> n3 [lhead=cluster_n2];
+  n3 -> n5 [ltail=cluster_n2];
+  n3 -> n5;
+}
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestWriteMermaid(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := testRunResult().WriteMermaid(out, false); err != nil {
+		t.Fatal(err)
+	}
+	want := `flowchart LR
+  subgraph n0 ["root [stage]"]
+    n1["build"]
+    subgraph n2 ["checks [parallel]"]
+      n3["lint"]
+      n4["say #quot;hi#quot;"]
+    end
+    n5["deploy"]
+  end
+  n1 --> n2
+  n2 --> n5
+  n3 --> n5
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
@@ -0,0 +1,72 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+)
+
+// Dir sets the working directory of the commands run by the task and by all of its children,
+// unless they set their own. A relative path is resolved against the workspace root, the
+// directory the builder was started in. The task fails if the directory does not exist when it starts.
+func (t *Task) Dir(path string) *Task {
+	t.dir = path
+	return t
+}
+
+// PipelineDir sets the working directory of every command in the workflow started by Begin.
+func PipelineDir(path string) {
+	pipeline.dir = path
+}
+
+// resolveDir returns the absolute path of a working directory set with Dir.
+func resolveDir(dir string) (string, error) {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir), nil
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return "", errors.Annotatef(err, "unable to find the workspace root")
+	}
+	return filepath.Join(root, dir), nil
+}
+
+// withDir checks the working directory of the task and returns a context carrying it, for the
+// commands of the task and its children.
+func (t *Task) withDir(ctx context.Context) (context.Context, error) {
+	if t.dir == "" {
+		return ctx, nil
+	}
+	dir, err := resolveDir(t.dir)
+	if err != nil {
+		return ctx, errors.Trace(err)
+	}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return ctx, errors.NotFoundf("working directory '%s' of %s", t.dir, t.label())
+	} else if err != nil {
+		return ctx, errors.Annotatef(err, "unable to use working directory '%s' of %s", t.dir, t.label())
+	}
+	if !info.IsDir() {
+		return ctx, errors.Errorf("working directory '%s' of %s is not a directory", t.dir, t.label())
+	}
+	return context.WithValue(ctx, dirKey, dir), nil
+}
+
+// workDir returns the working directory for commands run on behalf of the task that ctx belongs to.
+// Outside of a task this is the one set for the whole pipeline, or "" for the current directory.
+func workDir(ctx context.Context) string {
+	if dir, ok := ctx.Value(dirKey).(string); ok {
+		return dir
+	}
+	if pipeline.dir == "" {
+		return ""
+	}
+	dir, err := resolveDir(pipeline.dir)
+	if err != nil {
+		return ""
+	}
+	return dir
+}
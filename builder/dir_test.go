@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestDir(t *testing.T) {
+	workspace, err := filepath.EvalSymlinks(inTempWorkspace(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	StateDir(t.TempDir())
+	writeFile(t, "api/cmd/main.go", "")
+	writeFile(t, "web/index.html", "")
+	dirs := map[string]string{}
+	pwd := func(name string, c Command) *Task {
+		return Step(name, func(ctx context.Context) error {
+			c.Args = []string{"pwd", "-P"}
+			c.NoTee = true
+			result, err := RunCommand(ctx, c)
+			if err != nil {
+				return err
+			}
+			dirs[name] = strings.TrimPrefix(strings.TrimSpace(string(result.Stdout)), workspace)
+			return nil
+		})
+	}
+	root := Stage("root",
+		pwd("root", Command{}),
+		Stage("api",
+			pwd("api", Command{}),
+			// Relative directories are resolved against the workspace root, not the parent's directory
+			pwd("cmd", Command{}).Dir("api/cmd"),
+			pwd("command", Command{Dir: "web"}),
+		).Dir("api"),
+		pwd("absolute", Command{}).Dir(filepath.Join(workspace, "web")),
+	)
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"root": "", "api": "/api", "cmd": "/api/cmd", "command": "/web", "absolute": "/web"}
+	for name, dir := range want {
+		if dirs[name] != dir {
+			t.Errorf("%s ran in %q, want %q", name, dirs[name], dir)
+		}
+	}
+}
+
+func TestDirErrors(t *testing.T) {
+	inTempWorkspace(t)
+	StateDir(t.TempDir())
+	writeFile(t, "README.md", "")
+	ran := false
+	step := func() { ran = true }
+	err := callTask(context.Background(), Step("build", step).Dir("missing"))
+	if !errors.IsNotFound(err) || !strings.Contains(err.Error(), "working directory 'missing' of 'build' not found") {
+		t.Errorf("got error %v for a missing directory", err)
+	}
+	err = callTask(context.Background(), Step("build", step).Dir("README.md"))
+	if err == nil || !strings.Contains(err.Error(), "working directory 'README.md' of 'build' is not a directory") {
+		t.Errorf("got error %v for a file", err)
+	}
+	if ran {
+		t.Errorf("a task without its working directory ran")
+	}
+}
+
+func TestPipelineDir(t *testing.T) {
+	workspace := inTempWorkspace(t)
+	defer PipelineDir("")
+	if dir := workDir(context.Background()); dir != "" {
+		t.Errorf("got working directory %q without one set", dir)
+	}
+	PipelineDir("src")
+	if dir := workDir(context.Background()); dir != filepath.Join(workspace, "src") {
+		t.Errorf("got working directory %q", dir)
+	}
+}
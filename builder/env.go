@@ -0,0 +1,220 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/homelabtools/nanoci/secrets"
+	"github.com/juju/errors"
+)
+
+// envVar is a variable set with Env or SecretEnv.
+type envVar struct {
+	key    string
+	value  string
+	secret string
+}
+
+// envScope holds the environment settings of a task, or of the whole pipeline.
+type envScope struct {
+	files []string
+	vars  []envVar
+}
+
+// Env sets an environment variable for the commands run by the task and by all of its children.
+//
+// The environment of a command is made up of, from lowest to highest precedence:
+// the environment of the builder process, then for the pipeline and each enclosing task from the
+// outermost in, the variables loaded from its .env files followed by those set with Env and SecretEnv.
+// So a task overrides what it inherits, and a variable set explicitly overrides one loaded from a file.
+func (t *Task) Env(key, value string) *Task {
+	t.env.vars = append(t.env.vars, envVar{key: key, value: value})
+	return t
+}
+
+// SecretEnv sets an environment variable to the value of a secret, see Secret. The value is
+// only read when the task runs, and it is masked in the plan.
+func (t *Task) SecretEnv(key, secretName string) *Task {
+	t.env.vars = append(t.env.vars, envVar{key: key, secret: secretName})
+	return t
+}
+
+// EnvFile loads environment variables from .env files for the task and all of its children.
+// Later files override earlier ones, see Env for how they combine with other settings.
+// A missing file fails the task.
+func (t *Task) EnvFile(paths ...string) *Task {
+	t.env.files = append(t.env.files, paths...)
+	return t
+}
+
+// PipelineEnv sets an environment variable for every command in the workflow started by Begin.
+func PipelineEnv(key, value string) {
+	pipeline.env.vars = append(pipeline.env.vars, envVar{key: key, value: value})
+}
+
+// PipelineSecretEnv sets an environment variable to the value of a secret for every command
+// in the workflow started by Begin.
+func PipelineSecretEnv(key, secretName string) {
+	pipeline.env.vars = append(pipeline.env.vars, envVar{key: key, secret: secretName})
+}
+
+// PipelineEnvFile loads environment variables from .env files for every command in the workflow started by Begin.
+func PipelineEnvFile(paths ...string) {
+	pipeline.env.files = append(pipeline.env.files, paths...)
+}
+
+// apply returns the variables set by the enclosing scopes, inherited, overlaid with those of
+// this scope. Secrets are read from the secrets file, or replaced by a mask when reveal is false.
+func (s envScope) apply(inherited map[string]string, reveal bool) (map[string]string, error) {
+	env := map[string]string{}
+	for k, v := range inherited {
+		env[k] = v
+	}
+	lookup := func(key string) string {
+		if value, ok := env[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	}
+	for _, file := range s.files {
+		vars, err := loadEnvFile(file, lookup)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, v := range vars {
+			env[v.key] = v.value
+		}
+	}
+	for _, v := range s.vars {
+		switch {
+		case v.secret == "":
+			env[v.key] = v.value
+		case reveal:
+			value, err := Secret(v.secret)
+			if err != nil {
+				return nil, errors.Annotatef(err, "unable to set environment variable '%s'", v.key)
+			}
+			env[v.key] = value
+		default:
+			env[v.key] = secrets.Mask
+		}
+	}
+	return env, nil
+}
+
+// withEnv resolves the environment of the task and returns a context carrying it, for the
+// commands of the task and its children.
+func (t *Task) withEnv(ctx context.Context) (context.Context, error) {
+	if len(t.env.files) == 0 && len(t.env.vars) == 0 {
+		return ctx, nil
+	}
+	inherited, _ := ctx.Value(envKey).(map[string]string)
+	env, err := t.env.apply(inherited, true)
+	if err != nil {
+		return ctx, errors.Annotatef(err, "unable to set up the environment of %s", t.label())
+	}
+	return context.WithValue(ctx, envKey, env), nil
+}
+
+// scopedEnv returns the variables set for the task that ctx belongs to. Outside of a task
+// these are the ones set for the whole pipeline.
+func scopedEnv(ctx context.Context) (map[string]string, error) {
+	if env, ok := ctx.Value(envKey).(map[string]string); ok {
+		return env, nil
+	}
+	return pipeline.env.apply(nil, true)
+}
+
+// commandEnv returns the full environment for a command run on behalf of the task that ctx
+// belongs to, with extra variables appended.
+func commandEnv(ctx context.Context, extra ...string) ([]string, error) {
+	env, err := scopedEnv(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append(mergeEnv(os.Environ(), env), extra...), nil
+}
+
+// lookupEnv returns the value a variable has for the commands of the task that ctx belongs to.
+func lookupEnv(ctx context.Context, key string) string {
+	if env, ok := ctx.Value(envKey).(map[string]string); ok {
+		if value, ok := env[key]; ok {
+			return value
+		}
+	}
+	return os.Getenv(key)
+}
+
+// mergeEnv overlays vars onto base, a list of `key=value` strings, and returns the result sorted by key.
+func mergeEnv(base []string, vars map[string]string) []string {
+	merged := map[string]string{}
+	for _, kv := range base {
+		if i := strings.Index(kv, "="); i > 0 {
+			merged[kv[:i]] = kv[i+1:]
+		}
+	}
+	for k, v := range vars {
+		merged[k] = v
+	}
+	env := make([]string, 0, len(merged))
+	for k, v := range merged {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// loadEnvFile parses a .env file. Each line holds `key=value`, optionally preceded by `export`.
+// Blank lines and lines starting with # are ignored. Values may be single or double quoted, and
+// references like $NAME or ${NAME} in values that are not single quoted are expanded using lookup.
+func loadEnvFile(path string, lookup func(string) string) ([]envVar, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to load env file")
+	}
+	defer f.Close()
+	vars := []envVar{}
+	set := map[string]string{}
+	expand := func(key string) string {
+		if value, ok := set[key]; ok {
+			return value
+		}
+		return lookup(key)
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("%s:%d: expected key=value", path, lineNo)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+			value = os.Expand(value, expand)
+		default:
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+			value = os.Expand(value, expand)
+		}
+		set[key] = value
+		vars = append(vars, envVar{key: key, value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotatef(err, "unable to read env file %s", path)
+	}
+	return vars, nil
+}
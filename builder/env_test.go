@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeEnvFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	path := writeEnvFile(t, `
+# Comments and blank lines are ignored
+PLAIN=value
+export EXPORTED=exported
+  SPACED = spaced value  
+COMMENTED=value # a comment
+HASH=a#b
+SINGLE='$HOME is not expanded # nor is this a comment'
+DOUBLE="line one\nline \"two\" \\ $PLAIN"
+REFERENCE=${PLAIN}-$FROM_ENV
+MISSING=$NOT_SET
+EMPTY=
+EMPTY_QUOTED=""
+EQUALS=a=b
+`)
+	lookup := func(key string) string {
+		return map[string]string{"FROM_ENV": "env", "HOME": "/home/me", "PLAIN": "shadowed"}[key]
+	}
+	vars, err := loadEnvFile(path, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []envVar{
+		{key: "PLAIN", value: "value"},
+		{key: "EXPORTED", value: "exported"},
+		{key: "SPACED", value: "spaced value"},
+		{key: "COMMENTED", value: "value"},
+		{key: "HASH", value: "a#b"},
+		{key: "SINGLE", value: "$HOME is not expanded # nor is this a comment"},
+		{key: "DOUBLE", value: "line one\nline \"two\" \\ value"},
+		{key: "REFERENCE", value: "value-env"},
+		{key: "MISSING", value: ""},
+		{key: "EMPTY", value: ""},
+		{key: "EMPTY_QUOTED", value: ""},
+		{key: "EQUALS", value: "a=b"},
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", vars, want)
+	}
+}
+
+func TestLoadEnvFileErrors(t *testing.T) {
+	path := writeEnvFile(t, "GOOD=1\nnot a variable\n")
+	_, err := loadEnvFile(path, func(string) string { return "" })
+	if err == nil || !strings.Contains(err.Error(), ".env:2: expected key=value") {
+		t.Errorf("got error %v, want one naming line 2", err)
+	}
+	if _, err := loadEnvFile(filepath.Join(t.TempDir(), "missing.env"), func(string) string { return "" }); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,30 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TaskError is the error returned by a single task.
+type TaskError struct {
+	Task *Task
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Task.label(), e.Err.Error())
+}
+
+// TaskErrors collects the errors of tasks that failed independently of one another.
+type TaskErrors []*TaskError
+
+func (e TaskErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := []string{fmt.Sprintf("%d tasks failed:", len(e))}
+	for _, err := range e {
+		msgs = append(msgs, "  - "+err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// globRegexp converts a glob pattern to a regular expression. Besides the usual `*` and `?`,
+// the pattern may contain `**` which matches any number of directories.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	re := strings.Builder{}
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	return compiled, errors.Annotatef(err, "invalid glob pattern '%s'", pattern)
+}
+
+// globFiles returns the regular files below root that match any of the patterns, as sorted paths
+// relative to root using forward slashes. The .git and .nanoci directories are never searched.
+func globFiles(root string, patterns []string) ([]string, error) {
+	matched := map[string]bool{}
+	for _, pattern := range patterns {
+		re, err := globRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		// Only walk the part of the tree that can match, i.e. below the last directory without wildcards
+		base := filepath.ToSlash(filepath.Clean(pattern))
+		if i := strings.IndexAny(base, "*?"); i >= 0 {
+			base = filepath.Dir(base[:i] + "x")
+		}
+		err = filepath.Walk(filepath.Join(root, base), func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() && (info.Name() == ".git" || info.Name() == ".nanoci") {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if re.MatchString(rel) {
+				matched[rel] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to match files against '%s'", pattern)
+		}
+	}
+	files := []string{}
+	for file := range matched {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,34 @@
+package builder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGlobFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, file := range []string{"main.go", "cmd/app/main.go", "cmd/app/main_test.go", "docs/a.md", "docs/b.txt", ".git/config.go", "sub/.nanoci/run.go"} {
+		writeFile(t, filepath.Join(root, file), "")
+	}
+	tests := []struct {
+		patterns []string
+		want     string
+	}{
+		{[]string{"*.go"}, "main.go"},
+		{[]string{"**/*.go"}, "cmd/app/main.go cmd/app/main_test.go main.go"},
+		{[]string{"cmd/**"}, "cmd/app/main.go cmd/app/main_test.go"},
+		{[]string{"cmd/*/main?go"}, "cmd/app/main.go"},
+		{[]string{"docs/*.md", "./docs/*.md", "main.go"}, "docs/a.md main.go"},
+		{[]string{"missing/**"}, ""},
+	}
+	for _, test := range tests {
+		files, err := globFiles(root, test.patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(files, " "); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.patterns, got, test.want)
+		}
+	}
+}
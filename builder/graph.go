@@ -0,0 +1,469 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DependsOn declares tasks that must finish successfully before this task is started. If any of
+// them fails or is skipped, this task is skipped. Dependencies are honoured wherever the tasks are
+// in the workflow: a task waits for its dependencies before it starts, and the tasks of a Stage
+// are reordered so that dependencies come first. Begin fails before running anything if a
+// dependency cannot be honoured, e.g. because the dependency only runs after the task has started.
+func (t *Task) DependsOn(tasks ...*Task) *Task {
+	t.dependsOn = append(t.dependsOn, tasks...)
+	return t
+}
+
+// Graph runs tasks at the same time, each as soon as its dependencies declared with DependsOn have
+// finished. Dependencies that are not part of the workflow are pulled into the graph automatically.
+// If a task fails, every task downstream of it is skipped.
+func Graph(name string, tasks ...*Task) *Task {
+	g := &Task{name: name, kind: "graph", callLocation: callerLocation(1), children: tasks}
+	g.fn = func(ctx context.Context) error {
+		return schedule(ctx, name, g.children)
+	}
+	return g
+}
+
+// schedule runs the tasks of a graph at the same time. Each of them waits for its dependencies
+// in callTask.
+func schedule(ctx context.Context, name string, tasks []*Task) error {
+	mu := sync.Mutex{}
+	failures := TaskErrors{}
+	wg := sync.WaitGroup{}
+	for _, t := range tasks {
+		wg.Add(1)
+		go func(t *Task) {
+			defer wg.Done()
+			if ctx.Err() != nil {
+				t.skip(fmt.Sprintf("graph '%s' was cancelled", name))
+				return
+			}
+			err := callTask(ctx, t)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && !t.noFailOnError {
+				log.Error().Msgf(t.failureString()+" in graph '%s': %s", name, errors.ErrorStack(err))
+				failures = append(failures, &TaskError{Task: t, Err: err})
+				return
+			} else if err != nil && t.noFailOnError {
+				log.Error().Msgf(t.failureString()+" in graph '%s': %s", name, errors.ErrorStack(err))
+			}
+		}(t)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		return errors.Annotatef(failures, "graph '%s' failed", name)
+	}
+	return nil
+}
+
+// waitForDependencies waits until the task's dependencies and the sibling it starts after have
+// finished, returning why the task must be skipped if any of the dependencies did not succeed or
+// the sibling failed.
+func (t *Task) waitForDependencies(ctx context.Context) string {
+	waits := t.dependsOn
+	if t.after != nil {
+		waits = append(append([]*Task{}, waits...), t.after)
+	}
+	for _, dep := range waits {
+		select {
+		case <-dep.doneChan():
+		case <-ctx.Done():
+			return fmt.Sprintf("cancelled while waiting for %s", dep.label())
+		}
+	}
+	for _, dep := range t.dependsOn {
+		if !dep.succeeded() {
+			t.block(dep.failedOrBlocked())
+			return fmt.Sprintf("dependency %s did not succeed", dep.label())
+		}
+	}
+	if t.after != nil && t.after.failedOrBlocked() {
+		t.block(true)
+		return fmt.Sprintf("%s did not succeed", t.after.label())
+	}
+	return ""
+}
+
+// block records whether the task is skipped because a task it waited for failed or was blocked.
+func (t *Task) block(blocked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blocked = blocked
+}
+
+// failedOrBlocked reports whether the task failed, or was skipped because a task it waited for did.
+func (t *Task) failedOrBlocked() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status == StatusFailed || t.blocked
+}
+
+// sortTasks returns tasks and their transitive dependencies in topological order,
+// or an error naming the offending tasks if the dependencies contain a cycle.
+func sortTasks(tasks []*Task) ([]*Task, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[*Task]int{}
+	sorted := []*Task{}
+	var visit func(t *Task, path []*Task) error
+	visit = func(t *Task, path []*Task) error {
+		switch state[t] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, p := range path {
+				if p == t {
+					start = i
+				}
+			}
+			labels := []string{}
+			for _, p := range path[start:] {
+				labels = append(labels, p.label())
+			}
+			labels = append(labels, t.label())
+			return errors.Errorf("dependency cycle detected: %s", strings.Join(labels, " -> "))
+		}
+		state[t] = visiting
+		for _, dep := range t.dependsOn {
+			if err := visit(dep, append(path, t)); err != nil {
+				return err
+			}
+		}
+		state[t] = visited
+		sorted = append(sorted, t)
+		return nil
+	}
+	for _, t := range tasks {
+		if err := visit(t, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// hasDependencies reports whether any of the tasks declare dependencies, or whether any task
+// within them depends on a task that is not part of them, which must then be pulled into a graph.
+func hasDependencies(tasks []*Task) bool {
+	inTree := map[*Task]bool{}
+	for _, t := range tasks {
+		if len(t.dependsOn) > 0 {
+			return true
+		}
+		walkSubtasks(t, func(t *Task) {
+			inTree[t] = true
+		})
+	}
+	for t := range inTree {
+		for _, dep := range t.dependsOn {
+			if !inTree[dep] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkSubtasks calls fn for t and each of its descendants, including hooks.
+func walkSubtasks(t *Task, fn func(t *Task)) {
+	fn(t)
+	for _, child := range t.subtasks() {
+		walkSubtasks(child, fn)
+	}
+}
+
+// resolveDependencies prepares the workflow rooted at root for its dependencies. Dependencies that
+// are not part of the workflow are pulled into the nearest graph containing their dependents, the
+// children of every task are ordered so that dependencies come first, the children of ordered graphs
+// that have no dependencies are made to start after the child before them, and an error is returned
+// if a dependency cannot be honoured.
+func resolveDependencies(root *Task) error {
+	inTree := map[*Task]bool{}
+	walkSubtasks(root, func(t *Task) {
+		inTree[t] = true
+	})
+	var pullIn func(t, graph *Task) error
+	pullIn = func(t, graph *Task) error {
+		if t.kind == "graph" {
+			graph = t
+		}
+		for _, dep := range t.dependsOn {
+			if inTree[dep] {
+				continue
+			}
+			if graph == nil {
+				return errors.NotValidf("dependency of %s on %s, which is not part of the workflow,", t.label(), dep.label())
+			}
+			expandMatrices(dep)
+			graph.children = append(graph.children, dep)
+			walkSubtasks(dep, func(t *Task) {
+				inTree[t] = true
+			})
+			if err := pullIn(dep, graph); err != nil {
+				return err
+			}
+		}
+		for _, child := range t.subtasks() {
+			if err := pullIn(child, graph); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := pullIn(root, nil); err != nil {
+		return err
+	}
+	all := []*Task{}
+	walkSubtasks(root, func(t *Task) {
+		all = append(all, t)
+		t.children = orderChildren(t.children)
+		if t.ordered {
+			for i, child := range t.children {
+				if i > 0 && len(child.dependsOn) == 0 {
+					child.after = t.children[i-1]
+				}
+			}
+		}
+	})
+	if _, err := sortTasks(all); err != nil {
+		return err
+	}
+	return checkDependencies(root)
+}
+
+// orderChildren orders sibling tasks so that those containing the dependencies of others come
+// first, keeping the given order otherwise. Siblings that depend on one another are left as they are.
+func orderChildren(children []*Task) []*Task {
+	owner := map[*Task]int{}
+	for i, child := range children {
+		walkSubtasks(child, func(t *Task) {
+			owner[t] = i
+		})
+	}
+	needs := make([]map[int]bool, len(children))
+	for i, child := range children {
+		needs[i] = map[int]bool{}
+		walkSubtasks(child, func(t *Task) {
+			for _, dep := range t.dependsOn {
+				if j, ok := owner[dep]; ok && j != i {
+					needs[i][j] = true
+				}
+			}
+		})
+	}
+	ordered := make([]*Task, 0, len(children))
+	placed := make([]bool, len(children))
+	for len(ordered) < len(children) {
+		next := -1
+		for i := range children {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for j := range needs[i] {
+				if !placed[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			// The siblings depend on one another, which checkDependencies reports
+			return children
+		}
+		placed[next] = true
+		ordered = append(ordered, children[next])
+	}
+	return ordered
+}
+
+// event is the start or the end of a task.
+type event struct {
+	task *Task
+	end  bool
+}
+
+// checkDependencies checks that every dependency can be honoured given the order the workflow
+// runs its tasks in, i.e. that no task would wait for a dependency that can only finish after the
+// task has started. Children of a parallel task with a concurrency limit are checked as if they ran
+// one after another, as a child waiting for a dependency holds on to its slot.
+func checkDependencies(root *Task) error {
+	after := map[event][]event{}
+	order := func(before, next event) {
+		after[before] = append(after[before], next)
+	}
+	walkSubtasks(root, func(t *Task) {
+		start, end := event{t, false}, event{t, true}
+		order(start, end)
+		sequential := t.kind == "stage" ||
+			(t.maxConcurrency > 0 && t.maxConcurrency < len(t.children) && (t.kind == "parallel" || t.kind == "matrix"))
+		for i, child := range t.children {
+			order(start, event{child, false})
+			order(event{child, true}, end)
+			if sequential && i > 0 {
+				order(event{t.children[i-1], true}, event{child, false})
+			}
+		}
+		hooks := t.hooks.all()
+		for i, hook := range hooks {
+			order(start, event{hook, false})
+			order(event{hook, true}, end)
+			for _, child := range t.children {
+				order(event{child, true}, event{hook, false})
+			}
+			if i > 0 {
+				order(event{hooks[i-1], true}, event{hook, false})
+			}
+		}
+		for _, dep := range t.dependsOn {
+			order(event{dep, true}, start)
+		}
+		if t.after != nil {
+			order(event{t.after, true}, start)
+		}
+	})
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[event]int{}
+	var visit func(e event, path []event) error
+	visit = func(e event, path []event) error {
+		switch state[e] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := append(path, e)
+			for i := len(cycle) - 1; i > 0; i-- {
+				if cycle[i-1].end && !cycle[i].end && dependsOn(cycle[i].task, cycle[i-1].task) {
+					t, dep := cycle[i].task, cycle[i-1].task
+					return errors.Errorf("%s cannot depend on %s, as %s can only finish after %s has started",
+						t.label(), dep.label(), dep.label(), t.label())
+				}
+			}
+			return errors.Errorf("dependencies of %s cannot be honoured", e.task.label())
+		}
+		state[e] = visiting
+		for _, next := range after[e] {
+			if err := visit(next, append(path, e)); err != nil {
+				return err
+			}
+		}
+		state[e] = visited
+		return nil
+	}
+	return visit(event{root, false}, nil)
+}
+
+// dependsOn reports whether t declares dep as a dependency.
+func dependsOn(t, dep *Task) bool {
+	for _, d := range t.dependsOn {
+		if d == dep {
+			return true
+		}
+	}
+	return false
+}
+
+// callTask runs a task's function if its conditions hold, retrying it according to its retry policy.
+// A task skipped because of its conditions returns no error, as does one whose outputs were restored from the cache.
+func callTask(ctx context.Context, t *Task) error {
+	if reason := t.deselectedReason(); reason != "" {
+		t.skip(reason)
+		return nil
+	}
+	if reason := t.waitForDependencies(ctx); reason != "" {
+		t.skip(reason)
+		return nil
+	}
+	if ok, reason := t.shouldRun(); !ok {
+		t.skip(reason)
+		return nil
+	}
+	register(t)
+	t.begin()
+	run := func() error {
+		return t.runWithRetries(ctx, func(ctx context.Context) error {
+			return callTaskOnce(ctx, t)
+		})
+	}
+	ctx, err := t.withEnv(ctx)
+	if err == nil {
+		ctx, err = t.withDir(ctx)
+	}
+	if err == nil && t.cache != nil {
+		err = t.runCached(ctx, run)
+	} else if err == nil {
+		err = run()
+	}
+	t.skipUnstarted(fmt.Sprintf("%s finished without running it", t.label()))
+	if err == nil && len(t.artifacts) > 0 {
+		err = errors.Annotatef(t.collectArtifacts(), "failed to keep artifacts of %s", t.label())
+	}
+	err = t.runHooks(ctx, err)
+	t.closeLog()
+	t.finish(err)
+	return err
+}
+
+// callTaskOnce runs a task's function, converting a panic into an error so that one
+// misbehaving task running in a goroutine cannot bring down the whole process.
+// The task's timeouts are applied to the context it receives.
+func callTaskOnce(parent context.Context, t *Task) (err error) {
+	ctx := parent
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	var wd *watchdog
+	if t.inactivityTimeout > 0 {
+		ctx, wd = withWatchdog(ctx, t.inactivityTimeout)
+		defer wd.stop()
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if wd != nil && wd.expired() {
+			err = errors.Annotatef(err, "%s produced no output for %s", t.label(), t.inactivityTimeout)
+		} else if t.timeout > 0 && parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+			err = errors.Annotatef(err, "%s timed out after %s", t.label(), t.timeout)
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case error:
+				err = errors.Annotatef(r, "panic in %s", t.label())
+			default:
+				err = errors.Errorf("panic in %s: %+v", t.label(), r)
+			}
+		}
+	}()
+	return t.fn(context.WithValue(ctx, taskKey, t))
+}
+
+// label returns a short human readable description of the task.
+func (t *Task) label() string {
+	if t.name == "" {
+		return "task from " + t.callLocation
+	}
+	return fmt.Sprintf("'%s'", t.name)
+}
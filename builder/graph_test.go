@@ -0,0 +1,250 @@
+package builder
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func noop() {}
+
+func names(tasks []*Task) string {
+	labels := []string{}
+	for _, t := range tasks {
+		labels = append(labels, t.name)
+	}
+	return strings.Join(labels, " ")
+}
+
+func TestSortTasks(t *testing.T) {
+	build := Step("build", noop)
+	lint := Step("lint", noop)
+	test := Step("test", noop).DependsOn(build)
+	deploy := Step("deploy", noop).DependsOn(test, lint)
+	sorted, err := sortTasks([]*Task{deploy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(sorted); got != "build test lint deploy" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestSortTasksCycle(t *testing.T) {
+	a := Step("a", noop)
+	b := Step("b", noop).DependsOn(a)
+	c := Step("c", noop).DependsOn(b)
+	a.DependsOn(c)
+	_, err := sortTasks([]*Task{Step("d", noop), a})
+	if err == nil {
+		t.Fatal("expected a cycle to be detected")
+	}
+	if want := "dependency cycle detected: 'a' -> 'c' -> 'b' -> 'a'"; err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+
+	self := Step("self", noop)
+	self.DependsOn(self)
+	if _, err := sortTasks([]*Task{self}); err == nil {
+		t.Errorf("expected a task depending on itself to be a cycle")
+	}
+}
+
+func TestResolveDependencies(t *testing.T) {
+	build := Step("build", noop)
+	test := Step("test", noop).DependsOn(build)
+	stage := Stage("s", test, build)
+	if err := resolveDependencies(Stage("root", stage)); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(stage.children); got != "build test" {
+		t.Errorf("the stage was not reordered: %s", got)
+	}
+
+	// Dependencies that are not part of the workflow are pulled into the graph
+	external := Step("external", noop)
+	graph := Graph("g", Step("uses", noop).DependsOn(external))
+	if err := resolveDependencies(graph); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(graph.children); got != "external uses" {
+		t.Errorf("the dependency was not pulled into the graph: %s", got)
+	}
+	// ...but not into a stage
+	err := resolveDependencies(Stage("root", Step("uses", noop).DependsOn(Step("external", noop))))
+	if err == nil || !strings.Contains(err.Error(), "not part of the workflow") {
+		t.Errorf("expected an error for a dependency outside of a stage, got %v", err)
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	tests := []struct {
+		name  string
+		root  func() *Task
+		error string
+	}{{
+		name: "dependency in an earlier stage",
+		root: func() *Task {
+			build := Step("build", noop)
+			return Stage("root", Stage("s1", build), Stage("s2", Step("test", noop).DependsOn(build)))
+		},
+	}, {
+		name: "dependency in a later stage",
+		root: func() *Task {
+			release := Step("release", noop)
+			s1 := Stage("s1", Step("test", noop).DependsOn(release))
+			s2 := Stage("s2", release)
+			s2.DependsOn(s1)
+			return Graph("root", s1, s2)
+		},
+		error: "'test' cannot depend on 'release', as 'release' can only finish after 'test' has started",
+	}, {
+		name: "dependency on a parent",
+		root: func() *Task {
+			s := Stage("s")
+			s.children = []*Task{Step("child", noop).DependsOn(s)}
+			return Stage("root", s)
+		},
+		error: "'child' cannot depend on 's', as 's' can only finish after 'child' has started",
+	}, {
+		name: "dependency on a stage running later",
+		root: func() *Task {
+			deploy := Step("deploy", noop)
+			return Stage("root", Stage("s1", Step("smoke", noop).DependsOn(deploy)), Stage("s2", deploy), Stage("s3"))
+		},
+		// The stages are reordered to satisfy the dependency
+	}, {
+		name: "siblings in a parallel task",
+		root: func() *Task {
+			build := Step("build", noop)
+			return Stage("root", Parallel(Step("test", noop).DependsOn(build), build))
+		},
+	}, {
+		name: "siblings in a parallel task running one at a time",
+		root: func() *Task {
+			build := Step("build", noop)
+			return Stage("root", Parallel(Step("test", noop).DependsOn(build), build).MaxConcurrency(1))
+		},
+	}, {
+		name: "dependency on a hook",
+		root: func() *Task {
+			cleanup := Step("cleanup", noop)
+			s := Stage("s", Step("report", noop).DependsOn(cleanup))
+			s.Finally(cleanup)
+			return Stage("root", s)
+		},
+		error: "'report' cannot depend on 'cleanup'",
+	}}
+	for _, test := range tests {
+		err := resolveDependencies(test.root())
+		switch {
+		case test.error == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		case test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.error)
+		}
+	}
+}
+
+func TestDependenciesRunOnce(t *testing.T) {
+	StateDir(t.TempDir())
+	mu := sync.Mutex{}
+	runs := []string{}
+	step := func(name string) *Task {
+		return Step(name, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			runs = append(runs, name)
+		})
+	}
+	build := step("build")
+	test := step("test").DependsOn(build)
+	root := Graph("root", Stage("s1", build), test)
+	if err := resolveDependencies(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(runs, " "); got != "build test" {
+		t.Errorf("got runs %s, want build test", got)
+	}
+}
+
+// orderedGraph returns the root graph Begin would run the stages in.
+func orderedGraph(t *testing.T, stages ...*Task) *Task {
+	t.Helper()
+	root := Graph("root", stages...)
+	root.ordered = true
+	if err := resolveDependencies(root); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestOrderedGraph(t *testing.T) {
+	StateDir(t.TempDir())
+	mu := sync.Mutex{}
+	events := []string{}
+	step := func(name string, err error) *Task {
+		return Step(name, func() error {
+			mu.Lock()
+			events = append(events, name)
+			mu.Unlock()
+			return err
+		})
+	}
+	build := step("build", nil)
+	root := orderedGraph(t, step("lint", nil), build, step("test", nil).DependsOn(build), step("docs", nil), step("deploy", nil))
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(events, " "); got != "lint build test docs deploy" {
+		t.Errorf("stages without dependencies did not keep their order: %s", got)
+	}
+
+	events = nil
+	failing := step("lint", errors.New("lint failed"))
+	docs := step("docs", nil)
+	root = orderedGraph(t, failing, step("build", nil), docs)
+	if err := callTask(context.Background(), root); err == nil {
+		t.Fatal("expected the graph to fail")
+	}
+	if got := strings.Join(events, " "); got != "lint" {
+		t.Errorf("stages ran after a failure: %s", got)
+	}
+	if docs.Status() != StatusSkipped {
+		t.Errorf("a stage after a failure is %s, not skipped", docs.Status())
+	}
+}
+
+func TestOrderedGraphRunsDependentsEarly(t *testing.T) {
+	StateDir(t.TempDir())
+	started := make(chan struct{})
+	build := Step("build", noop)
+	// docs only finishes once test has started, which it can as test does not wait for docs
+	docs := Step("docs", func() error {
+		select {
+		case <-started:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("test did not start while docs ran")
+		}
+	})
+	test := Step("test", func() { close(started) }).DependsOn(build)
+	root := orderedGraph(t, build, docs, test)
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if test.after != nil || docs.after != build {
+		t.Errorf("unexpected order: test after %v, docs after %v", test.after, docs.after)
+	}
+	r := root.Result()
+	if r.Children[1].After != "root/build" {
+		t.Errorf("the result of docs says it ran after %q", r.Children[1].After)
+	}
+}
@@ -0,0 +1,198 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GroupOutput makes a parallel task buffer the output of each of its children and print it as one
+// block, between a header and a footer showing how the child did, once the child is finished.
+// While the children run, a terminal shows a line with the status of each of them.
+// The --output grouped option does the same for every parallel task.
+func (t *Task) GroupOutput() *Task {
+	t.groupOutput = true
+	return t
+}
+
+// groupsOutput reports whether the task prints the output of its children in blocks.
+func (t *Task) groupsOutput() bool {
+	return t.groupOutput || cli.output == "grouped"
+}
+
+// outputGroup buffers the console output of a task and everything it runs. It is only written to
+// while console is held.
+type outputGroup struct {
+	task *Task
+	buf  bytes.Buffer
+}
+
+func (g *outputGroup) Write(p []byte) (int, error) {
+	return g.buf.Write(p)
+}
+
+// withOutputGroup returns a context in which the console output of the task's commands goes to a new group.
+func withOutputGroup(ctx context.Context, t *Task) (context.Context, *outputGroup) {
+	g := &outputGroup{task: t}
+	return context.WithValue(ctx, groupKey, g), g
+}
+
+// print writes the group's output to the console as one block.
+func (g *outputGroup) print() {
+	name := g.task.path
+	if name == "" {
+		name = g.task.displayName()
+	}
+	footer := fmt.Sprintf("=== %s: %s", name, g.task.Status())
+	if started, ended := g.task.startTime(), g.task.endTime(); !started.IsZero() && !ended.IsZero() {
+		footer += " in " + ended.Sub(started).Round(time.Millisecond).String()
+	}
+	block := &bytes.Buffer{}
+	fmt.Fprintf(block, "=== %s\n", name)
+	block.Write(g.buf.Bytes())
+	fmt.Fprintln(block, footer)
+	writeConsole(os.Stdout, block.Bytes())
+}
+
+// console serialises writes to the console, so that lines of tasks running at the same time are not
+// mixed up, and so that the status board can be moved out of the way.
+var console sync.Mutex
+
+// writeConsole writes p to w, which is the console unless it is an output group.
+func writeConsole(w io.Writer, p []byte) (int, error) {
+	console.Lock()
+	defer console.Unlock()
+	if _, ok := w.(*outputGroup); ok {
+		return w.Write(p)
+	}
+	board.clear()
+	defer board.draw()
+	return w.Write(p)
+}
+
+// consoleWriter writes to the console through writeConsole.
+type consoleWriter struct {
+	w io.Writer
+}
+
+func (c consoleWriter) Write(p []byte) (int, error) {
+	return writeConsole(c.w, p)
+}
+
+// board is the live status display of the children of parallel tasks with grouped output.
+var board = &statusBoard{out: os.Stderr}
+
+// statusBoard shows one line per running task at the bottom of a terminal. It is only changed
+// while console is held.
+type statusBoard struct {
+	out     io.Writer
+	tasks   []*Task
+	drawn   int
+	running bool
+}
+
+// isTerminal reports whether f is a terminal that can show the status board.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// add shows the tasks on the board, if stderr is a terminal.
+func (b *statusBoard) add(tasks ...*Task) {
+	if !isTerminal(os.Stderr) {
+		return
+	}
+	console.Lock()
+	defer console.Unlock()
+	b.clear()
+	b.tasks = append(b.tasks, tasks...)
+	b.draw()
+	if !b.running {
+		b.running = true
+		go b.refresh()
+	}
+}
+
+// remove takes the tasks off the board.
+func (b *statusBoard) remove(tasks ...*Task) {
+	console.Lock()
+	defer console.Unlock()
+	b.clear()
+	defer b.draw()
+	remaining := b.tasks[:0]
+	for _, t := range b.tasks {
+		keep := true
+		for _, removed := range tasks {
+			if t == removed {
+				keep = false
+			}
+		}
+		if keep {
+			remaining = append(remaining, t)
+		}
+	}
+	b.tasks = remaining
+}
+
+// refresh redraws the board regularly, so that the elapsed times stay current, until it is empty.
+func (b *statusBoard) refresh() {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		console.Lock()
+		if len(b.tasks) == 0 {
+			b.running = false
+			console.Unlock()
+			return
+		}
+		b.clear()
+		b.draw()
+		console.Unlock()
+	}
+}
+
+// clear erases the board from the terminal.
+func (b *statusBoard) clear() {
+	if b.drawn == 0 {
+		return
+	}
+	io.WriteString(b.out, strings.Repeat("\x1b[1A\x1b[2K", b.drawn))
+	b.drawn = 0
+}
+
+// draw writes the board below the output so far.
+func (b *statusBoard) draw() {
+	if len(b.tasks) == 0 {
+		return
+	}
+	lines := &bytes.Buffer{}
+	for _, t := range b.tasks {
+		name := t.path
+		if name == "" {
+			name = t.displayName()
+		}
+		elapsed := ""
+		if started := t.startTime(); !started.IsZero() {
+			elapsed = formatElapsed(time.Since(started))
+		}
+		fmt.Fprintf(lines, "  %-8s %9s  %s\n", t.Status(), elapsed, name)
+	}
+	if _, err := b.out.Write(lines.Bytes()); err != nil {
+		return
+	}
+	b.drawn = len(b.tasks)
+}
+
+// runGrouped runs a child of a parallel task with grouped output and prints its output once it is finished.
+func runGrouped(ctx context.Context, t *Task) error {
+	ctx, g := withOutputGroup(ctx, t)
+	err := callTask(ctx, t)
+	board.remove(t)
+	g.print()
+	return err
+}
@@ -0,0 +1,210 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RunRecord is what is kept about a finished run in its run directory.
+type RunRecord struct {
+	ID       string        `json:"id"`
+	Pipeline string        `json:"pipeline"`
+	Status   Status        `json:"status"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration time.Duration `json:"duration"`
+	Git      GitInfo       `json:"git"`
+	Result   *Result       `json:"result"`
+}
+
+// GitInfo describes the revision of the workspace a run was started in.
+type GitInfo struct {
+	Commit  string `json:"commit,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Dirty   bool   `json:"dirty,omitempty"`
+}
+
+var pipelineName string
+
+// PipelineName sets the name runs of this pipeline are recorded under.
+// It defaults to $NANOCI_PIPELINE, or the name of the working directory.
+func PipelineName(name string) {
+	pipelineName = name
+}
+
+func currentPipelineName() string {
+	if pipelineName != "" {
+		return pipelineName
+	}
+	if name := os.Getenv("NANOCI_PIPELINE"); name != "" {
+		return name
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "pipeline"
+	}
+	return filepath.Base(wd)
+}
+
+// currentGitInfo describes the git revision of the working directory, leaving fields empty
+// when they cannot be determined, e.g. outside of a git repository.
+func currentGitInfo() GitInfo {
+	info := GitInfo{Branch: CurrentBranch()}
+	git := func(args ...string) string {
+		out, err := exec.Command("git", args...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	info.Commit = git("rev-parse", "HEAD")
+	if info.Commit != "" {
+		info.Subject = git("log", "-1", "--format=%s")
+		info.Dirty = git("status", "--porcelain") != ""
+	}
+	return info
+}
+
+// newRunRecord describes the current run, given its result.
+func newRunRecord(result *Result) *RunRecord {
+	return &RunRecord{
+		ID:       RunID(),
+		Pipeline: currentPipelineName(),
+		Status:   result.Status,
+		Start:    result.Start,
+		End:      result.End,
+		Duration: result.Duration,
+		Git:      currentGitInfo(),
+		Result:   result,
+	}
+}
+
+// saveRun records the current run in the run directory. The output of its tasks is
+// already there, see appendLog.
+func saveRun(record *RunRecord) error {
+	dir, err := currentRunDir()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	record.ID = filepath.Base(dir)
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotatef(ioutil.WriteFile(filepath.Join(dir, "run.json"), data, 0644), "failed to write run record")
+}
+
+// taskLogFile returns the file the output of the task with the given path is kept in.
+func taskLogFile(runDir, taskPath string) string {
+	parts := strings.Split(taskPath, "/")
+	for i, part := range parts {
+		parts[i] = sanitizeFileName(part)
+	}
+	return filepath.Join(runDir, "logs", filepath.Join(parts...)+".log")
+}
+
+// sanitizeFileName replaces the characters of name that are awkward in file names.
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == '=':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// ListRuns returns the records of all finished runs, the most recent first. Records that cannot be
+// read are logged and left out, so that one damaged run does not hide the others.
+func ListRuns() ([]*RunRecord, error) {
+	entries, err := ioutil.ReadDir(runsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to list runs")
+	}
+	records := []*RunRecord{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		record, err := LoadRun(entry.Name())
+		if errors.IsNotFound(err) {
+			// The run is still in progress or was interrupted before it was recorded
+			continue
+		}
+		if err != nil {
+			log.Warn().Msgf("Skipping run %s: %s", entry.Name(), err)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID > records[j].ID
+	})
+	return records, nil
+}
+
+// previousRun returns the last run of the same pipeline on the same branch that started before
+// the given one, or nil if there is none.
+func previousRun(record *RunRecord) (*RunRecord, error) {
+	records, err := ListRuns()
+	if err != nil {
+		return nil, err
+	}
+	var previous *RunRecord
+	for _, r := range records {
+		if r.ID == record.ID || r.Pipeline != record.Pipeline || r.Git.Branch != record.Git.Branch || !r.Start.Before(record.Start) {
+			continue
+		}
+		if previous == nil || r.Start.After(previous.Start) {
+			previous = r
+		}
+	}
+	return previous, nil
+}
+
+// LoadRun returns the record of the run with the given ID.
+func LoadRun(runID string) (*RunRecord, error) {
+	data, err := ioutil.ReadFile(filepath.Join(runsDir(), runID, "run.json"))
+	if os.IsNotExist(err) {
+		return nil, errors.NotFoundf("run '%s'", runID)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read run '%s'", runID)
+	}
+	record := &RunRecord{}
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to parse run '%s'", runID)
+	}
+	return record, nil
+}
+
+// TaskLog returns the output of a task in a finished run, given the task's path.
+func TaskLog(runID, taskPath string) (string, error) {
+	record, err := LoadRun(runID)
+	if err != nil {
+		return "", err
+	}
+	if record.Result.Find(taskPath) == nil {
+		return "", errors.NotFoundf("task '%s' in run '%s'", taskPath, runID)
+	}
+	data, err := ioutil.ReadFile(taskLogFile(filepath.Join(runsDir(), runID), taskPath))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(data), errors.Annotatef(err, "failed to read log of task '%s'", taskPath)
+}
@@ -0,0 +1,114 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRun records a finished run in the state directory.
+func writeRun(t *testing.T, record *RunRecord) {
+	t.Helper()
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(runsDir(), record.ID, "run.json"), string(data))
+}
+
+func runIDs(records []*RunRecord) string {
+	ids := []string{}
+	for _, r := range records {
+		ids = append(ids, r.ID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestListRuns(t *testing.T) {
+	StateDir(t.TempDir())
+	if records, err := ListRuns(); err != nil || len(records) != 0 {
+		t.Errorf("got %v, %v before any run", records, err)
+	}
+	writeRun(t, &RunRecord{ID: "20260101-100000-aaaaaa", Status: StatusSuccess})
+	writeRun(t, &RunRecord{ID: "20260103-100000-cccccc", Status: StatusFailed})
+	writeRun(t, &RunRecord{ID: "20260102-100000-bbbbbb", Status: StatusSuccess})
+	// A damaged record, a run in progress and a stray file are all left out
+	writeFile(t, filepath.Join(runsDir(), "20260104-100000-dddddd", "run.json"), "{")
+	if err := os.MkdirAll(filepath.Join(runsDir(), "20260105-100000-eeeeee"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(runsDir(), "notes.txt"), "")
+	records, err := ListRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "20260103-100000-cccccc 20260102-100000-bbbbbb 20260101-100000-aaaaaa"
+	if got := runIDs(records); got != want {
+		t.Errorf("got runs %s, want %s", got, want)
+	}
+	if _, err := LoadRun("20260104-100000-dddddd"); err == nil || !strings.Contains(err.Error(), "failed to parse run") {
+		t.Errorf("loading the damaged run returned %v", err)
+	}
+}
+
+func TestPreviousRun(t *testing.T) {
+	StateDir(t.TempDir())
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	run := func(id, pipeline, branch string, hours int) *RunRecord {
+		r := &RunRecord{ID: id, Pipeline: pipeline, Git: GitInfo{Branch: branch}, Start: start.Add(time.Duration(hours) * time.Hour)}
+		writeRun(t, r)
+		return r
+	}
+	run("1", "nanoci", "main", 0)
+	run("2", "nanoci", "main", 1)
+	run("3", "nanoci", "feature", 2)
+	run("4", "other", "main", 3)
+	current := run("5", "nanoci", "main", 4)
+	run("6", "nanoci", "main", 5)
+	previous, err := previousRun(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous == nil || previous.ID != "2" {
+		t.Errorf("got previous run %v, want 2", previous)
+	}
+	first, err := previousRun(&RunRecord{ID: "1", Pipeline: "nanoci", Git: GitInfo{Branch: "main"}, Start: start})
+	if err != nil || first != nil {
+		t.Errorf("got previous run %v, %v of the first run", first, err)
+	}
+}
+
+func TestSaveRun(t *testing.T) {
+	startTestRun(t)
+	root := Stage("root", Step("build", func(ctx context.Context) error {
+		_, err := RunCommand(ctx, Command{Script: "echo compiled", NoTee: true})
+		return err
+	}))
+	walkTasks(root, "", func(t *Task, taskPath string, depth int) {
+		t.path = taskPath
+	})
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveRun(newRunRecord(root.Result())); err != nil {
+		t.Fatal(err)
+	}
+	record, err := LoadRun(RunID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != StatusSuccess || record.Result.Find("root/build") == nil {
+		t.Errorf("the run was recorded as %s without its tasks", record.Status)
+	}
+	output, err := TaskLog(RunID(), "root/build")
+	if err != nil || !strings.HasSuffix(output, " compiled\n") {
+		t.Errorf("got log %q, %v", output, err)
+	}
+	if _, err := TaskLog(RunID(), "root/test"); err == nil {
+		t.Errorf("the log of a task that is not in the run was found")
+	}
+}
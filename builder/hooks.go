@@ -0,0 +1,159 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// hooks are tasks run after a task has finished, depending on its outcome.
+type hooks struct {
+	onSuccess []*Task
+	onFailure []*Task
+	finally   []*Task
+}
+
+func (h *hooks) all() []*Task {
+	all := append([]*Task{}, h.onSuccess...)
+	all = append(all, h.onFailure...)
+	return append(all, h.finally...)
+}
+
+// OnSuccess runs the tasks, one after another, after this task has succeeded.
+func (t *Task) OnSuccess(tasks ...*Task) *Task {
+	t.hooks.onSuccess = append(t.hooks.onSuccess, tasks...)
+	return t
+}
+
+// OnFailure runs the tasks, one after another, after this task has failed, timed out or panicked.
+func (t *Task) OnFailure(tasks ...*Task) *Task {
+	t.hooks.onFailure = append(t.hooks.onFailure, tasks...)
+	return t
+}
+
+// Finally runs the tasks, one after another, after this task has finished, whatever the outcome.
+// They run after any OnSuccess or OnFailure tasks, and are meant for cleaning up.
+func (t *Task) Finally(tasks ...*Task) *Task {
+	t.hooks.finally = append(t.hooks.finally, tasks...)
+	return t
+}
+
+// OnSuccess runs the tasks after the whole workflow started by Begin has succeeded.
+func OnSuccess(tasks ...*Task) {
+	pipeline.hooks.onSuccess = append(pipeline.hooks.onSuccess, tasks...)
+}
+
+// OnFailure runs the tasks after the whole workflow started by Begin has failed.
+func OnFailure(tasks ...*Task) {
+	pipeline.hooks.onFailure = append(pipeline.hooks.onFailure, tasks...)
+}
+
+// Finally runs the tasks after the whole workflow started by Begin has finished, whatever the outcome.
+func Finally(tasks ...*Task) {
+	pipeline.hooks.finally = append(pipeline.hooks.finally, tasks...)
+}
+
+// defaultHookTimeout is how long the hooks of a task may run unless HookTimeout says otherwise.
+const defaultHookTimeout = 10 * time.Minute
+
+// HookTimeout limits how long the OnSuccess, OnFailure and Finally tasks of a task may run together,
+// 10 minutes by default. Hooks run even after the workflow was cancelled or timed out, so this keeps
+// a hanging cleanup from holding up the end of the run forever. A second interrupt stops them at once.
+func HookTimeout(d time.Duration) {
+	pipeline.hookTimeout = d
+}
+
+// runHooks runs the hooks of a task that finished with err. Hooks run even if the task was
+// cancelled or timed out, until the hook timeout is up or the run is aborted. If err is nil, the
+// error of the first failing hook is returned. Otherwise hook failures are only logged, so that
+// they never hide the task's own error.
+func (t *Task) runHooks(ctx context.Context, err error) error {
+	if len(t.hooks.all()) == 0 {
+		return err
+	}
+	ctx, cancel := hookContext(ctx)
+	defer cancel()
+	var run, skipped []*Task
+	var reason string
+	if err == nil {
+		run, skipped = t.hooks.onSuccess, t.hooks.onFailure
+		reason = t.label() + " succeeded"
+	} else {
+		run, skipped = t.hooks.onFailure, t.hooks.onSuccess
+		reason = t.label() + " failed"
+	}
+	for _, hook := range skipped {
+		hook.skip(reason)
+	}
+	run = append(append([]*Task{}, run...), t.hooks.finally...)
+	var hookErr error
+	for _, hook := range run {
+		if ctx.Err() != nil {
+			hook.skip(hooksStopped(ctx, t))
+			continue
+		}
+		e := callTask(ctx, hook)
+		if e != nil && ctx.Err() != nil {
+			e = errors.Annotatef(e, "%s", hooksStopped(ctx, t))
+		}
+		if e == nil || hook.noFailOnError {
+			continue
+		}
+		log.Error().Msgf("%s, run after %s: %s", hook.failureString(), t.label(), errors.ErrorStack(e))
+		if hookErr == nil {
+			hookErr = errors.Annotatef(e, "hook of %s failed", t.label())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return hookErr
+}
+
+// hookContext returns the context the hooks of a task run in. It keeps the values of ctx but is
+// not cancelled along with it, only once the hook timeout is up or the run is aborted.
+func hookContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	stop, ok := ctx.Value(abortKey).(context.Context)
+	if !ok {
+		stop = context.Background()
+	}
+	timeout := pipeline.hookTimeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	return context.WithTimeout(detachedContext{parent: ctx, stop: stop}, timeout)
+}
+
+// hooksStopped says why the hooks of t were stopped.
+func hooksStopped(ctx context.Context, t *Task) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Sprintf("the hooks of %s ran out of time", t.label())
+	}
+	return "the run was aborted"
+}
+
+// detachedContext keeps the values of its parent but is not cancelled along with it, so that
+// cleanup can run after the parent was cancelled or timed out. It is only cancelled with stop.
+type detachedContext struct {
+	parent context.Context
+	stop   context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return c.stop.Done()
+}
+
+func (c detachedContext) Err() error {
+	return c.stop.Err()
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,146 @@
+package builder
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// recorder records the order tasks ran in.
+type recorder struct {
+	mu  sync.Mutex
+	ran []string
+}
+
+func (r *recorder) step(name string, err error) *Task {
+	return Step(name, func() error {
+		r.mu.Lock()
+		r.ran = append(r.ran, name)
+		r.mu.Unlock()
+		return err
+	})
+}
+
+func (r *recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.ran, " ")
+}
+
+func TestHooks(t *testing.T) {
+	StateDir(t.TempDir())
+	tests := []struct {
+		name    string
+		taskErr error
+		hookErr error
+		ran     string
+		error   string
+	}{
+		{name: "success", ran: "task on-success cleanup"},
+		{name: "failure", taskErr: errors.New("task failed"), ran: "task on-failure cleanup", error: "task failed"},
+		{name: "hook failure", hookErr: errors.New("cleanup failed"), ran: "task on-success cleanup", error: "cleanup failed"},
+		{name: "both failed", taskErr: errors.New("task failed"), hookErr: errors.New("cleanup failed"), ran: "task on-failure cleanup", error: "task failed"},
+	}
+	for _, test := range tests {
+		r := &recorder{}
+		onSuccess := r.step("on-success", nil)
+		onFailure := r.step("on-failure", nil)
+		task := r.step("task", test.taskErr).OnSuccess(onSuccess).OnFailure(onFailure).Finally(r.step("cleanup", test.hookErr))
+		err := callTask(context.Background(), task)
+		if r.String() != test.ran {
+			t.Errorf("%s: ran %s, want %s", test.name, r, test.ran)
+		}
+		switch {
+		case test.error == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		case test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.error)
+		case test.taskErr != nil && test.hookErr != nil && strings.Contains(err.Error(), "cleanup failed"):
+			t.Errorf("%s: the hook's error hides the task's", test.name)
+		}
+		skipped := onSuccess
+		if test.taskErr == nil {
+			skipped = onFailure
+		}
+		if skipped.Status() != StatusSkipped {
+			t.Errorf("%s: the hook that should not run is %s", test.name, skipped.Status())
+		}
+	}
+}
+
+func TestHooksRunAfterCancellation(t *testing.T) {
+	StateDir(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &recorder{}
+	task := Step("task", func(ctx context.Context) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}).Finally(r.step("cleanup", nil))
+	callTask(ctx, task)
+	if r.String() != "cleanup" {
+		t.Errorf("the hook did not run after the task was cancelled")
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	StateDir(t.TempDir())
+	HookTimeout(50 * time.Millisecond)
+	defer HookTimeout(0)
+	r := &recorder{}
+	hang := Step("hang", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	after := r.step("after", nil)
+	task := Step("task", noop).Finally(hang, after)
+	err := callTask(context.Background(), task)
+	if err == nil || !strings.Contains(err.Error(), "the hooks of 'task' ran out of time") {
+		t.Errorf("got error %v, want the hooks to run out of time", err)
+	}
+	if r.String() != "" || after.Status() != StatusSkipped {
+		t.Errorf("a hook ran after the hooks ran out of time")
+	}
+}
+
+func TestHooksAborted(t *testing.T) {
+	StateDir(t.TempDir())
+	abortCtx, abort := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), abortKey, abortCtx))
+	defer cancel()
+	started := make(chan struct{})
+	hang := Step("hang", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	task := Step("task", func(ctx context.Context) error {
+		cancel()
+		return ctx.Err()
+	}).Finally(hang)
+	go func() {
+		<-started
+		abort()
+	}()
+	done := make(chan struct{})
+	go func() {
+		callTask(ctx, task)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("aborting the run did not stop the hook")
+	}
+	if hang.Status() != StatusFailed {
+		t.Errorf("the aborted hook is %s, not failed", hang.Status())
+	}
+}
@@ -0,0 +1,135 @@
+package builder
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the result as JUnit XML to w. Every task that contains other tasks, such as
+// a Stage or Parallel, becomes a <testsuite> named by its path, and the tasks without children
+// inside it become its <testcase> elements.
+func (r *Result) WriteJUnit(w io.Writer) error {
+	suites := junitTestSuites{Name: r.Name, Time: junitSeconds(r)}
+	r.junitSuites(r.Name, &suites)
+	for _, suite := range suites.Suites {
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return errors.Annotatef(err, "failed to encode JUnit report")
+	}
+	_, err = io.WriteString(w, "\n")
+	return errors.Trace(err)
+}
+
+// WriteJUnitFile writes the result as JUnit XML to the named file.
+func (r *Result) WriteJUnitFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return errors.Annotatef(err, "failed to create JUnit report '%s'", filename)
+	}
+	defer file.Close()
+	return errors.Annotatef(r.WriteJUnit(file), "failed to write JUnit report '%s'", filename)
+}
+
+// junitSuites adds a suite for r, if it has any direct children without children of their own,
+// and then does the same for its descendants.
+func (r *Result) junitSuites(suitePath string, suites *junitTestSuites) {
+	suite := junitTestSuite{Name: suitePath, Time: junitSeconds(r)}
+	if !r.Start.IsZero() {
+		suite.Timestamp = r.Start.Format("2006-01-02T15:04:05")
+	}
+	for _, child := range r.Children {
+		if len(child.Children) > 0 {
+			continue
+		}
+		suite.Cases = append(suite.Cases, child.junitTestCase(suitePath))
+		suite.Tests++
+		switch child.Status {
+		case StatusFailed:
+			suite.Failures++
+		case StatusSkipped, StatusPending:
+			suite.Skipped++
+		}
+	}
+	if suite.Tests > 0 {
+		suites.Suites = append(suites.Suites, suite)
+	}
+	for _, child := range r.Children {
+		if len(child.Children) > 0 {
+			child.junitSuites(suitePath+"/"+child.Name, suites)
+		}
+	}
+}
+
+func (r *Result) junitTestCase(className string) junitTestCase {
+	tc := junitTestCase{
+		Name:      r.Name,
+		ClassName: className,
+		Time:      junitSeconds(r),
+		File:      r.CallLocation,
+		SystemOut: r.Output,
+	}
+	switch r.Status {
+	case StatusFailed:
+		tc.Failure = &junitMessage{Message: r.Error, Text: r.ErrorStack}
+	case StatusSkipped:
+		tc.Skipped = &junitMessage{Message: r.SkipReason}
+	case StatusPending:
+		tc.Skipped = &junitMessage{Message: "task did not run"}
+	case StatusAllowedFailure:
+		tc.SystemErr = "failure allowed by NoFailOnError:\n" + r.ErrorStack
+	}
+	return tc
+}
+
+func junitSeconds(r *Result) string {
+	return fmt.Sprintf("%.3f", r.Duration.Seconds())
+}
@@ -0,0 +1,50 @@
+package builder
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	result := &Result{Name: "root", Kind: "stage", Status: StatusFailed, Start: start, Duration: 3 * time.Second, Children: []*Result{
+		{Name: "build", Kind: "step", Status: StatusSuccess, Duration: 1500 * time.Millisecond, CallLocation: "ci/main.go:11", Output: "compiled\n"},
+		{Name: "checks", Kind: "parallel", Status: StatusFailed, Start: start, Duration: time.Second, Children: []*Result{
+			{Name: "lint", Kind: "step", Status: StatusAllowedFailure, ErrorStack: "lint failed"},
+			{Name: "test", Kind: "step", Status: StatusFailed, Error: "2 tests failed", ErrorStack: "ci/main.go:20: 2 tests failed"},
+		}},
+		{Name: "deploy", Kind: "step", Status: StatusSkipped, SkipReason: "branch is not main"},
+		{Name: "notify", Kind: "step", Status: StatusPending},
+	}}
+	out := &bytes.Buffer{}
+	if err := result.WriteJUnit(out); err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="root" tests="5" failures="1" skipped="2" time="3.000">
+  <testsuite name="root" tests="3" failures="0" skipped="2" time="3.000" timestamp="2026-01-02T03:04:05">
+    <testcase name="build" classname="root" time="1.500" file="ci/main.go:11">
+      <system-out>compiled&#xA;</system-out>
+    </testcase>
+    <testcase name="deploy" classname="root" time="0.000">
+      <skipped message="branch is not main"></skipped>
+    </testcase>
+    <testcase name="notify" classname="root" time="0.000">
+      <skipped message="task did not run"></skipped>
+    </testcase>
+  </testsuite>
+  <testsuite name="root/checks" tests="2" failures="1" skipped="0" time="1.000" timestamp="2026-01-02T03:04:05">
+    <testcase name="lint" classname="root/checks" time="0.000">
+      <system-err>failure allowed by NoFailOnError:&#xA;lint failed</system-err>
+    </testcase>
+    <testcase name="test" classname="root/checks" time="0.000">
+      <failure message="2 tests failed">ci/main.go:20: 2 tests failed</failure>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
@@ -0,0 +1,178 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// matrixSpec is what a matrix task is expanded from.
+type matrixSpec struct {
+	axes     map[string][]string
+	build    func(Args) *Task
+	includes []Args
+	excludes []Args
+	expanded bool
+}
+
+// Matrix runs a task for every combination of values of the axes, e.g. every GOOS and GOARCH pair.
+// build is called once per combination with Args holding that combination's value for each axis,
+// when the workflow containing the matrix is run or planned. The tasks run in parallel, use
+// MaxConcurrency and FailFast to control this, and Include and Exclude to add or remove combinations.
+func Matrix(axes map[string][]string, build func(Args) *Task) *Task {
+	m := &Task{kind: "matrix", callLocation: callerLocation(1), matrix: &matrixSpec{axes: axes, build: build}}
+	m.fn = func(ctx context.Context) error {
+		err := runParallel(ctx, m, m.children)
+		for _, cell := range m.children {
+			log.Info().Msgf("Matrix cell %s: %s", cell.label(), cell.Status())
+		}
+		return err
+	}
+	return m
+}
+
+// Include adds combinations to a matrix task. A combination that has the same axis values as an
+// existing one adds its extra values to it, otherwise it becomes a combination of its own.
+func (t *Task) Include(cells ...Args) *Task {
+	if t.matrix == nil {
+		panic(errors.New("Include can only be used on a task created with Matrix"))
+	}
+	t.matrix.includes = append(t.matrix.includes, cells...)
+	return t
+}
+
+// Exclude removes combinations from a matrix task. A combination is removed if it has all of the
+// values of any of the given partial combinations.
+func (t *Task) Exclude(cells ...Args) *Task {
+	if t.matrix == nil {
+		panic(errors.New("Exclude can only be used on a task created with Matrix"))
+	}
+	t.matrix.excludes = append(t.matrix.excludes, cells...)
+	return t
+}
+
+// expandMatrices creates the tasks of every matrix within t, including matrices within those tasks.
+func expandMatrices(t *Task) {
+	if t.matrix != nil {
+		t.expandMatrix()
+	}
+	for _, child := range t.subtasks() {
+		expandMatrices(child)
+	}
+}
+
+// expandMatrix creates a task for every combination of the matrix, once.
+func (t *Task) expandMatrix() {
+	spec := t.matrix
+	if spec.expanded {
+		return
+	}
+	spec.expanded = true
+	t.children = nil
+	for _, cell := range matrixCells(spec) {
+		child := spec.build(cell)
+		if child.name == "" {
+			child.name = cellName(cell)
+		} else {
+			child.name = fmt.Sprintf("%s (%s)", child.name, cellName(cell))
+		}
+		t.children = append(t.children, child)
+	}
+}
+
+// matrixCells returns the combinations of a matrix, after applying its excludes and includes.
+func matrixCells(spec *matrixSpec) []Args {
+	keys := []string{}
+	for key := range spec.axes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	cells := []Args{{}}
+	for _, key := range keys {
+		expanded := []Args{}
+		for _, cell := range cells {
+			for _, value := range spec.axes[key] {
+				next := Args{key: value}
+				for k, v := range cell {
+					next[k] = v
+				}
+				expanded = append(expanded, next)
+			}
+		}
+		cells = expanded
+	}
+	if len(keys) == 0 {
+		cells = nil
+	}
+	kept := []Args{}
+	for _, cell := range cells {
+		excluded := false
+		for _, exclude := range spec.excludes {
+			if cellHas(cell, exclude) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, cell)
+		}
+	}
+	for _, include := range spec.includes {
+		merged := false
+		for _, cell := range kept {
+			if cellHasAxes(include, cell, keys) {
+				for k, v := range include {
+					cell[k] = v
+				}
+				merged = true
+			}
+		}
+		if !merged {
+			cell := Args{}
+			for k, v := range include {
+				cell[k] = v
+			}
+			kept = append(kept, cell)
+		}
+	}
+	return kept
+}
+
+// cellHas reports whether cell has all of the values in partial.
+func cellHas(cell, partial Args) bool {
+	for k, v := range partial {
+		if fmt.Sprint(cell[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// cellHasAxes reports whether include sets every axis, with the same value as cell.
+func cellHasAxes(include, cell Args, axes []string) bool {
+	for _, key := range axes {
+		v, ok := include[key]
+		if !ok || fmt.Sprint(v) != fmt.Sprint(cell[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// cellName describes a combination as "key1=value1, key2=value2" with the keys sorted.
+func cellName(cell Args) string {
+	keys := []string{}
+	for key := range cell {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", key, cell[key]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func cellNames(m *Task) []string {
+	names := []string{}
+	for _, child := range m.children {
+		names = append(names, child.name)
+	}
+	return names
+}
+
+func TestMatrix(t *testing.T) {
+	axes := map[string][]string{"os": {"linux", "darwin"}, "arch": {"amd64", "arm64"}}
+	tests := []struct {
+		name  string
+		build func(m *Task)
+		want  []string
+	}{{
+		name:  "every combination",
+		build: func(m *Task) {},
+		want:  []string{"arch=amd64, os=linux", "arch=amd64, os=darwin", "arch=arm64, os=linux", "arch=arm64, os=darwin"},
+	}, {
+		name: "exclude a combination",
+		build: func(m *Task) {
+			m.Exclude(Args{"os": "darwin", "arch": "amd64"})
+		},
+		want: []string{"arch=amd64, os=linux", "arch=arm64, os=linux", "arch=arm64, os=darwin"},
+	}, {
+		name: "exclude a partial combination",
+		build: func(m *Task) {
+			m.Exclude(Args{"os": "darwin"})
+		},
+		want: []string{"arch=amd64, os=linux", "arch=arm64, os=linux"},
+	}, {
+		name: "include extra values",
+		build: func(m *Task) {
+			m.Include(Args{"os": "linux", "arch": "arm64", "cgo": "1"})
+		},
+		want: []string{"arch=amd64, os=linux", "arch=amd64, os=darwin", "arch=arm64, cgo=1, os=linux", "arch=arm64, os=darwin"},
+	}, {
+		name: "include a new combination",
+		build: func(m *Task) {
+			m.Include(Args{"os": "windows", "arch": "amd64"}, Args{"os": "linux"})
+		},
+		want: []string{"arch=amd64, os=linux", "arch=amd64, os=darwin", "arch=arm64, os=linux", "arch=arm64, os=darwin", "arch=amd64, os=windows", "os=linux"},
+	}, {
+		name: "include after exclude",
+		build: func(m *Task) {
+			m.Include(Args{"os": "darwin", "arch": "amd64"}).Exclude(Args{"os": "darwin"})
+		},
+		want: []string{"arch=amd64, os=linux", "arch=arm64, os=linux", "arch=amd64, os=darwin"},
+	}}
+	for _, test := range tests {
+		calls := 0
+		m := Matrix(axes, func(cell Args) *Task {
+			calls++
+			return Step(noop)
+		})
+		test.build(m)
+		if calls != 0 {
+			t.Errorf("%s: the matrix was expanded before the workflow started", test.name)
+		}
+		expandMatrices(Stage("root", m))
+		expandMatrices(m)
+		if got := cellNames(m); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got\n%q\nwant\n%q", test.name, got, test.want)
+		}
+		if calls != len(test.want) {
+			t.Errorf("%s: build was called %d times for %d combinations", test.name, calls, len(test.want))
+		}
+	}
+}
+
+func TestMatrixNames(t *testing.T) {
+	m := Matrix(map[string][]string{"go": {"1.15"}}, func(cell Args) *Task {
+		inner := Matrix(map[string][]string{"db": {"postgres"}}, func(inner Args) *Task {
+			return Step("test", noop)
+		})
+		return Stage("go "+cell["go"].(string), inner)
+	})
+	expandMatrices(m)
+	if got := cellNames(m); !reflect.DeepEqual(got, []string{"go 1.15 (go=1.15)"}) {
+		t.Errorf("got %q", got)
+	}
+	if got := cellNames(m.children[0].children[0]); !reflect.DeepEqual(got, []string{"test (db=postgres)"}) {
+		t.Errorf("matrices within a matrix were not expanded: %q", got)
+	}
+}
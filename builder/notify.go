@@ -0,0 +1,270 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Sink delivers notifications somewhere, see WebhookSink, EmailSink, NtfySink and GotifySink.
+type Sink interface {
+	Send(ctx context.Context, m *Message) error
+}
+
+// Message is a notification about a finished run, rendered from the templates of its Notification.
+type Message struct {
+	Title string
+	Body  string
+	Run   *RunSummary
+}
+
+// RunSummary is what notification templates are executed with. Besides the fields of the run's
+// record, such as .Pipeline, .Status, .Duration, .Git.Branch and .Result, it has the following.
+type RunSummary struct {
+	*RunRecord
+	// Previous is the previous run of the same pipeline on the same branch, nil if there is none.
+	Previous       *RunRecord `json:"-"`
+	PreviousStatus Status     `json:"previousStatus,omitempty"`
+	// Changed is set when the run failed and the previous one did not, or the other way around.
+	// A first run counts as a change only if it failed.
+	Changed bool `json:"changed"`
+	// Failures are the tasks that failed, without the stages they failed in.
+	Failures []*Result `json:"failures,omitempty"`
+	// Summary is the table of tasks printed at the end of the run.
+	Summary string `json:"summary"`
+	// URL links to the run, if $NANOCI_RUN_URL is set, as it is by nanoci serve.
+	URL string `json:"url,omitempty"`
+}
+
+// Outcome describes the run in a word or two: "succeeded", "failed", "fixed" or "still failing".
+func (s *RunSummary) Outcome() string {
+	failed := s.Status == StatusFailed
+	previousFailed := s.Previous != nil && s.Previous.Status == StatusFailed
+	switch {
+	case failed && previousFailed:
+		return "still failing"
+	case failed:
+		return "failed"
+	case previousFailed:
+		return "fixed"
+	default:
+		return "succeeded"
+	}
+}
+
+// The default templates of notifications.
+const (
+	defaultTitleTemplate = `{{.Pipeline}}{{with .Git.Branch}} ({{.}}){{end}} {{.Outcome}}`
+	defaultBodyTemplate  = `Run {{.ID}} {{.Status}} in {{round .Duration}}` +
+		`{{with .Git.Commit}} at {{short .}}{{end}}{{with .Git.Subject}}: {{.}}{{end}}` + "\n" +
+		`{{range .Failures}}{{.Path}}: {{.Error}}` + "\n" + `{{end}}{{with .URL}}{{.}}` + "\n" + `{{end}}`
+)
+
+// templateFuncs are available in notification templates, along with those of text/template.
+var templateFuncs = template.FuncMap{
+	// short shortens a commit hash
+	"short": func(commit string) string {
+		if len(commit) > 7 {
+			return commit[:7]
+		}
+		return commit
+	},
+	// round rounds a duration to milliseconds
+	"round": func(d time.Duration) time.Duration {
+		return d.Round(time.Millisecond)
+	},
+}
+
+// Notification sends a message through a sink when the workflow started by Begin has finished,
+// if all of its rules hold. See Notify.
+type Notification struct {
+	sink  Sink
+	rules []notificationRule
+	title string
+	body  string
+}
+
+// notificationRule decides whether a notification is sent, describing itself for logs.
+type notificationRule struct {
+	description string
+	check       func(s *RunSummary) bool
+}
+
+var notifications []*Notification
+
+// Notify sends a notification through the sink when the workflow started by Begin has finished,
+// after the run has been recorded. By default it is sent after every run; OnlyOnFailure,
+// OnlyOnChange and When restrict that. Failing to send a notification does not fail the run.
+// --no-notify disables all notifications, e.g. for local runs.
+func Notify(sink Sink) *Notification {
+	n := &Notification{sink: sink, title: defaultTitleTemplate, body: defaultBodyTemplate}
+	notifications = append(notifications, n)
+	return n
+}
+
+// OnlyOnFailure sends the notification only if the run failed.
+func (n *Notification) OnlyOnFailure() *Notification {
+	n.rules = append(n.rules, notificationRule{"run failed", func(s *RunSummary) bool {
+		return s.Status == StatusFailed
+	}})
+	return n
+}
+
+// OnlyOnChange sends the notification only if the run failed while the previous one on the same
+// branch did not, or the other way around, e.g. when main breaks or is fixed.
+func (n *Notification) OnlyOnChange() *Notification {
+	n.rules = append(n.rules, notificationRule{"outcome changed", func(s *RunSummary) bool {
+		return s.Changed
+	}})
+	return n
+}
+
+// When sends the notification only if all of the conditions hold once the run has finished,
+// e.g. OnBranch("main").
+func (n *Notification) When(conditions ...Condition) *Notification {
+	for _, c := range conditions {
+		c := c
+		n.rules = append(n.rules, notificationRule{c.description, func(*RunSummary) bool {
+			return c.check()
+		}})
+	}
+	return n
+}
+
+// Title sets the text/template the title of the message is made from. It is executed with
+// the *RunSummary of the run.
+func (n *Notification) Title(text string) *Notification {
+	n.title = text
+	return n
+}
+
+// Body sets the text/template the body of the message is made from. It is executed with
+// the *RunSummary of the run, e.g. "{{.Summary}}" gives the table of all tasks.
+func (n *Notification) Body(text string) *Notification {
+	n.body = text
+	return n
+}
+
+// templates parses the title and body templates of the notification.
+func (n *Notification) templates() (title, body *template.Template, err error) {
+	title, err = template.New("title").Funcs(templateFuncs).Parse(n.title)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "invalid notification title")
+	}
+	body, err = template.New("body").Funcs(templateFuncs).Parse(n.body)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "invalid notification body")
+	}
+	return title, body, nil
+}
+
+// checkNotifications checks the templates of all notifications, so that mistakes in them
+// show up before the pipeline runs rather than after.
+func checkNotifications() error {
+	for _, n := range notifications {
+		if n.sink == nil {
+			return errors.NotValidf("notification without a sink")
+		}
+		if _, _, err := n.templates(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// message renders the notification for a run.
+func (n *Notification) message(s *RunSummary) (*Message, error) {
+	title, body, err := n.templates()
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Run: s}
+	buf := &bytes.Buffer{}
+	if err := title.Execute(buf, s); err != nil {
+		return nil, errors.Annotatef(err, "unable to render notification title")
+	}
+	// Titles are a single line for every sink
+	m.Title = masker.String(strings.Join(strings.Fields(buf.String()), " "))
+	buf.Reset()
+	if err := body.Execute(buf, s); err != nil {
+		return nil, errors.Annotatef(err, "unable to render notification body")
+	}
+	m.Body = masker.String(strings.TrimSpace(buf.String()))
+	return m, nil
+}
+
+// sendNotifications sends the notifications whose rules hold for a finished run.
+func sendNotifications(record *RunRecord) {
+	if len(notifications) == 0 || cli.noNotify {
+		return
+	}
+	summary := summarizeRun(record)
+	for _, n := range notifications {
+		if ok, reason := n.shouldSend(summary); !ok {
+			log.Debug().Msgf("Not sending notification through %T: %s", n.sink, reason)
+			continue
+		}
+		m, err := n.message(summary)
+		if err != nil {
+			log.Error().Msgf("Unable to send notification through %T: %s", n.sink, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = n.sink.Send(ctx, m)
+		cancel()
+		if err != nil {
+			log.Error().Msgf("Unable to send notification through %T: %s", n.sink, errors.ErrorStack(err))
+			continue
+		}
+		log.Info().Msgf("Sent notification '%s' through %T", m.Title, n.sink)
+	}
+}
+
+// shouldSend checks the rules of the notification, returning the one that does not hold if any.
+func (n *Notification) shouldSend(s *RunSummary) (bool, string) {
+	for _, rule := range n.rules {
+		if !rule.check(s) {
+			return false, "rule '" + rule.description + "' does not hold"
+		}
+	}
+	return true, ""
+}
+
+// summarizeRun gathers what notification templates need to know about a run.
+func summarizeRun(record *RunRecord) *RunSummary {
+	s := &RunSummary{RunRecord: record, URL: os.Getenv("NANOCI_RUN_URL")}
+	previous, err := previousRun(record)
+	if err != nil {
+		log.Warn().Msgf("Unable to find the run before %s: %s", record.ID, err)
+	}
+	s.Previous = previous
+	if previous != nil {
+		s.PreviousStatus = previous.Status
+		s.Changed = (previous.Status == StatusFailed) != (record.Status == StatusFailed)
+	} else {
+		s.Changed = record.Status == StatusFailed
+	}
+	if record.Result != nil {
+		record.Result.Walk(func(r *Result, depth int) {
+			if r.Status != StatusFailed {
+				return
+			}
+			for _, child := range r.Children {
+				if child.Status == StatusFailed {
+					return
+				}
+			}
+			s.Failures = append(s.Failures, r)
+		})
+		buf := &bytes.Buffer{}
+		record.Result.PrintSummary(buf)
+		s.Summary = buf.String()
+	}
+	return s
+}
@@ -0,0 +1,177 @@
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// recordingSink keeps the messages it is asked to send.
+type recordingSink struct {
+	messages []*Message
+	err      error
+}
+
+func (s *recordingSink) Send(ctx context.Context, m *Message) error {
+	s.messages = append(s.messages, m)
+	return s.err
+}
+
+// resetNotifications forgets the notifications added by the test when it ends.
+func resetNotifications(t *testing.T) {
+	t.Cleanup(func() {
+		notifications = nil
+		cli.noNotify = false
+	})
+}
+
+func failedResult() *Result {
+	return &Result{Name: "root", Path: "root", Status: StatusFailed, Children: []*Result{
+		{Name: "build", Path: "root/build", Status: StatusSuccess},
+		{Name: "checks", Path: "root/checks", Status: StatusFailed, Children: []*Result{
+			{Name: "lint", Path: "root/checks/lint", Status: StatusFailed, Error: "2 problems"},
+			{Name: "test", Path: "root/checks/test", Status: StatusFailed, Error: "3 tests failed"},
+		}},
+	}}
+}
+
+func TestSummarizeRun(t *testing.T) {
+	StateDir(t.TempDir())
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		previous, current Status
+		outcome           string
+		changed           bool
+	}{
+		{current: StatusSuccess, outcome: "succeeded"},
+		{current: StatusFailed, outcome: "failed", changed: true},
+		{previous: StatusSuccess, current: StatusSuccess, outcome: "succeeded"},
+		{previous: StatusSuccess, current: StatusFailed, outcome: "failed", changed: true},
+		{previous: StatusFailed, current: StatusFailed, outcome: "still failing"},
+		{previous: StatusFailed, current: StatusSuccess, outcome: "fixed", changed: true},
+	}
+	for i, test := range tests {
+		pipeline := "pipeline" + string(rune('a'+i))
+		if test.previous != "" {
+			writeRun(t, &RunRecord{ID: pipeline + "-1", Pipeline: pipeline, Status: test.previous, Start: start})
+		}
+		record := &RunRecord{ID: pipeline + "-2", Pipeline: pipeline, Status: test.current, Start: start.Add(time.Hour)}
+		s := summarizeRun(record)
+		if s.Outcome() != test.outcome || s.Changed != test.changed || s.PreviousStatus != test.previous {
+			t.Errorf("%s after %q: got %s, changed %v, previous %q", test.current, test.previous, s.Outcome(), s.Changed, s.PreviousStatus)
+		}
+	}
+	s := summarizeRun(&RunRecord{ID: "with-result", Pipeline: "nanoci", Status: StatusFailed, Result: failedResult()})
+	failures := []string{}
+	for _, r := range s.Failures {
+		failures = append(failures, r.Path)
+	}
+	if strings.Join(failures, " ") != "root/checks/lint root/checks/test" {
+		t.Errorf("got failures %v, want the tasks that failed without the stages", failures)
+	}
+	if !strings.HasPrefix(s.Summary, "TASK") || !strings.Contains(s.Summary, "lint") {
+		t.Errorf("got summary %q", s.Summary)
+	}
+}
+
+func TestNotificationRules(t *testing.T) {
+	resetNotifications(t)
+	failed := &RunSummary{RunRecord: &RunRecord{Status: StatusFailed}, Changed: true}
+	fixed := &RunSummary{RunRecord: &RunRecord{Status: StatusSuccess}, Changed: true}
+	passing := &RunSummary{RunRecord: &RunRecord{Status: StatusSuccess}}
+	tests := []struct {
+		notification *Notification
+		summary      *RunSummary
+		reason       string
+	}{
+		{Notify(&recordingSink{}), passing, ""},
+		{Notify(&recordingSink{}).OnlyOnFailure(), failed, ""},
+		{Notify(&recordingSink{}).OnlyOnFailure(), fixed, "rule 'run failed' does not hold"},
+		{Notify(&recordingSink{}).OnlyOnChange(), fixed, ""},
+		{Notify(&recordingSink{}).OnlyOnChange(), passing, "rule 'outcome changed' does not hold"},
+		{Notify(&recordingSink{}).OnlyOnChange().When(EnvSet("NANOCI_TEST_UNSET")), failed, "rule '$NANOCI_TEST_UNSET is set' does not hold"},
+	}
+	for i, test := range tests {
+		ok, reason := test.notification.shouldSend(test.summary)
+		if ok != (test.reason == "") || reason != test.reason {
+			t.Errorf("%d: got %v (%s), want %q", i, ok, reason, test.reason)
+		}
+	}
+}
+
+func TestNotificationMessage(t *testing.T) {
+	resetNotifications(t)
+	MaskValue("hunter2")
+	s := &RunSummary{
+		RunRecord: &RunRecord{
+			ID:       "20260101-100000-abcdef",
+			Pipeline: "nanoci",
+			Status:   StatusFailed,
+			Duration: 83123456 * time.Microsecond,
+			Git:      GitInfo{Branch: "main", Commit: "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c", Subject: "Add notifications"},
+		},
+		Failures: []*Result{{Path: "root/deploy", Error: "login with hunter2 refused"}},
+		URL:      "https://ci.example.com/runs/20260101-100000-abcdef",
+	}
+	m, err := Notify(&recordingSink{}).message(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title != "nanoci (main) failed" {
+		t.Errorf("got title %q", m.Title)
+	}
+	want := "Run 20260101-100000-abcdef failed in 1m23.123s at b6589fc: Add notifications\n" +
+		"root/deploy: login with *** refused\n" +
+		"https://ci.example.com/runs/20260101-100000-abcdef"
+	if m.Body != want {
+		t.Errorf("got body\n%s\nwant\n%s", m.Body, want)
+	}
+	m, err = Notify(&recordingSink{}).Title("{{.Pipeline}}\n  {{.Outcome}}").Body("{{range .Failures}}{{.Path}} {{end}}").message(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title != "nanoci failed" || m.Body != "root/deploy" {
+		t.Errorf("got %q, %q", m.Title, m.Body)
+	}
+}
+
+func TestCheckNotifications(t *testing.T) {
+	resetNotifications(t)
+	Notify(&recordingSink{})
+	if err := checkNotifications(); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	Notify(&recordingSink{}).Body("{{.Status")
+	if err := checkNotifications(); err == nil || !strings.Contains(err.Error(), "invalid notification body") {
+		t.Errorf("got error %v for an invalid template", err)
+	}
+	notifications = nil
+	Notify(nil)
+	if err := checkNotifications(); !errors.IsNotValid(err) {
+		t.Errorf("got error %v for a notification without a sink", err)
+	}
+}
+
+func TestSendNotifications(t *testing.T) {
+	resetNotifications(t)
+	StateDir(t.TempDir())
+	broken := &recordingSink{err: errors.New("unreachable")}
+	always := &recordingSink{}
+	onFailure := &recordingSink{}
+	Notify(broken)
+	Notify(always)
+	Notify(onFailure).OnlyOnFailure()
+	record := &RunRecord{ID: "20260101-100000-abcdef", Pipeline: "nanoci", Status: StatusSuccess}
+	sendNotifications(record)
+	if len(broken.messages) != 1 || len(always.messages) != 1 || len(onFailure.messages) != 0 {
+		t.Errorf("sent %d, %d and %d messages, want 1, 1 and 0", len(broken.messages), len(always.messages), len(onFailure.messages))
+	}
+	cli.noNotify = true
+	sendNotifications(record)
+	if len(always.messages) != 1 {
+		t.Errorf("a notification was sent with --no-notify")
+	}
+}
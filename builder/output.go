@@ -0,0 +1,192 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// OutputEnvVar names the environment variable holding the path of the file that commands run by
+// SH or ExternalProcess can write `key=value` lines to in order to publish outputs of their task.
+const OutputEnvVar = "NANOCI_OUTPUT"
+
+// registry keeps track of the tasks of the workflow started by Begin and of those that have run,
+// so that their outputs can be looked up by name or path.
+var registry = struct {
+	sync.Mutex
+	tasks map[*Task]bool
+}{tasks: map[*Task]bool{}}
+
+func register(t *Task) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.tasks[t] = true
+}
+
+// registeredTask returns the task with the given name or path, which may leave out the leading
+// "root/". It is an error if more than one task has the name.
+func registeredTask(name string) (*Task, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	found := []*Task{}
+	for t := range registry.tasks {
+		if name != "" && (t.name == name || t.path == name || strings.TrimPrefix(t.path, "root/") == name) {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, errors.Errorf("no task named '%s' has run", name)
+	case 1:
+		return found[0], nil
+	}
+	paths := []string{}
+	for _, t := range found {
+		paths = append(paths, t.path)
+	}
+	sort.Strings(paths)
+	return nil, errors.Errorf("there is more than one task named '%s', refer to one of %s by its path", name, strings.Join(paths, ", "))
+}
+
+// SetOutput publishes a named output of the task that ctx was passed to.
+func SetOutput(ctx context.Context, key, value string) error {
+	t, ok := ctx.Value(taskKey).(*Task)
+	if !ok {
+		return errors.Errorf("unable to set output '%s', the context does not belong to a task", key)
+	}
+	t.setOutput(key, value)
+	return nil
+}
+
+func (t *Task) setOutput(key, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.outputs == nil {
+		t.outputs = map[string]string{}
+	}
+	t.outputs[key] = value
+}
+
+// Output returns a named output published by the task.
+func (t *Task) Output(key string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	value, ok := t.outputs[key]
+	return value, ok
+}
+
+// Outputs returns a copy of all outputs published by the task.
+func (t *Task) Outputs() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outputs := map[string]string{}
+	for k, v := range t.outputs {
+		outputs[k] = v
+	}
+	return outputs
+}
+
+// OutputOf returns a named output published by the task with the given name, which must already
+// have run. Tasks that share a name, such as those in different stages, must be referred to by
+// their path instead, e.g. "build/api" or "root/build/api".
+func OutputOf(taskName, key string) (string, error) {
+	t, err := registeredTask(taskName)
+	if err != nil {
+		return "", err
+	}
+	value, ok := t.Output(key)
+	if !ok {
+		return "", errors.Errorf("task '%s' has no output named '%s'", taskName, key)
+	}
+	return value, nil
+}
+
+// OutputRef is a placeholder for an output of another task. When used as a value in the Args
+// passed to Inside, it is replaced with the output right before the external process starts.
+type OutputRef struct {
+	// Task is the name or path of the task, see OutputOf.
+	Task string
+	Key  string
+}
+
+// resolveArgs returns a copy of args with every OutputRef replaced by the output it refers to.
+func resolveArgs(args Args) (Args, error) {
+	resolved := Args{}
+	for k, v := range args {
+		if ref, ok := v.(OutputRef); ok {
+			value, err := OutputOf(ref.Task, ref.Key)
+			if err != nil {
+				return nil, errors.Annotatef(err, "unable to resolve argument '%s'", k)
+			}
+			v = value
+		}
+		resolved[k] = v
+	}
+	return resolved, nil
+}
+
+// outputFile is a temporary file that a command can write outputs for its task into.
+type outputFile struct {
+	task *Task
+	path string
+}
+
+// newOutputFile creates an output file for the task that ctx belongs to. It returns nil if there is no task.
+func newOutputFile(ctx context.Context) (*outputFile, error) {
+	t, ok := ctx.Value(taskKey).(*Task)
+	if !ok {
+		return nil, nil
+	}
+	f, err := ioutil.TempFile("", "nanoci-output-")
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to create output file")
+	}
+	f.Close()
+	return &outputFile{task: t, path: f.Name()}, nil
+}
+
+// env returns the environment variable entry pointing a command to the file.
+// It is safe to call on a nil outputFile.
+func (o *outputFile) env() []string {
+	if o == nil {
+		return nil
+	}
+	return []string{OutputEnvVar + "=" + o.path}
+}
+
+// remove deletes the file. It is safe to call on a nil outputFile.
+func (o *outputFile) remove() {
+	if o != nil {
+		os.Remove(o.path)
+	}
+}
+
+// collect reads the `key=value` lines written to the file into the task's outputs.
+func (o *outputFile) collect() error {
+	f, err := os.Open(o.path)
+	if err != nil {
+		return errors.Annotatef(err, "failed to read output file")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return errors.Errorf("line %d of $%s is not of the form key=value: %s", lineNum, OutputEnvVar, line)
+		}
+		o.task.setOutput(line[:i], line[i+1:])
+	}
+	return errors.Trace(scanner.Err())
+}
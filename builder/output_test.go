@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// resetRegistry forgets the tasks registered by earlier tests.
+func resetRegistry(t *testing.T) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.tasks = map[*Task]bool{}
+}
+
+func TestOutputOf(t *testing.T) {
+	resetRegistry(t)
+	StateDir(t.TempDir())
+	publish := func(name, value string) *Task {
+		return Step(name, func(ctx context.Context) error {
+			return SetOutput(ctx, "version", value)
+		})
+	}
+	api := publish("build", "1.0.0-api")
+	web := publish("build", "1.0.0-web")
+	tag := publish("tag", "v1.0.0")
+	root := Stage("root", Stage("api", api), Stage("web", web), tag)
+	walkTasks(root, "", func(t *Task, taskPath string, depth int) {
+		t.path = taskPath
+	})
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		task, key, want, error string
+	}{
+		{task: "tag", key: "version", want: "v1.0.0"},
+		{task: "root/api/build", key: "version", want: "1.0.0-api"},
+		{task: "web/build", key: "version", want: "1.0.0-web"},
+		{task: "build", key: "version", error: "refer to one of root/api/build, root/web/build by its path"},
+		{task: "deploy", key: "version", error: "no task named 'deploy' has run"},
+		{task: "tag", key: "commit", error: "task 'tag' has no output named 'commit'"},
+	}
+	for _, test := range tests {
+		got, err := OutputOf(test.task, test.key)
+		switch {
+		case test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)):
+			t.Errorf("%s %s: got error %v, want %q", test.task, test.key, err, test.error)
+		case test.error == "" && err != nil:
+			t.Errorf("%s %s: %s", test.task, test.key, err)
+		case got != test.want:
+			t.Errorf("%s %s: got %q, want %q", test.task, test.key, got, test.want)
+		}
+	}
+}
+
+func TestSetOutputOutsideTask(t *testing.T) {
+	if err := SetOutput(context.Background(), "version", "1"); err == nil {
+		t.Errorf("expected an error setting an output without a task")
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	resetRegistry(t)
+	StateDir(t.TempDir())
+	task := Step("version", func(ctx context.Context) error {
+		_, err := RunCommand(ctx, Command{Script: `echo "version=1.2.3" >> "$NANOCI_OUTPUT"; echo "commit=abc=def" >> "$NANOCI_OUTPUT"`})
+		return err
+	})
+	if err := callTask(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := task.Outputs(), map[string]string{"version": "1.2.3", "commit": "abc=def"}; len(got) != 2 || got["version"] != want["version"] || got["commit"] != want["commit"] {
+		t.Errorf("got outputs %v, want %v", got, want)
+	}
+	args, err := resolveArgs(Args{"version": OutputRef{Task: "version", Key: "version"}, "plain": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args["version"] != "1.2.3" || args["plain"] != 1 {
+		t.Errorf("got args %v", args)
+	}
+
+	bad := Step("bad", func(ctx context.Context) error {
+		_, err := RunCommand(ctx, Command{Script: `echo "not an output" >> "$NANOCI_OUTPUT"`})
+		return err
+	})
+	if err := callTask(context.Background(), bad); err == nil || !strings.Contains(err.Error(), "not of the form key=value") {
+		t.Errorf("got error %v for a malformed output", err)
+	}
+}
@@ -0,0 +1,217 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// PlanStep describes what would happen to a task if the pipeline was run.
+type PlanStep struct {
+	Name         string `json:"name"`
+	Path         string `json:"path"`
+	Kind         string `json:"kind"`
+	CallLocation string `json:"callLocation"`
+	// Order numbers the tasks that would run by their position in the plan, depth first, and is 0
+	// for those that would be skipped. It is not the order tasks start in: Concurrent tasks and
+	// their children start together with their siblings, whatever their numbers.
+	Order int `json:"order,omitempty"`
+	// Concurrent is set when the task would run at the same time as its siblings.
+	Concurrent bool   `json:"concurrent,omitempty"`
+	Skip       bool   `json:"skip,omitempty"`
+	SkipReason string `json:"skipReason,omitempty"`
+	// Hook is set for the tasks that would run after their parent by OnSuccess, OnFailure or Finally.
+	Hook bool `json:"hook,omitempty"`
+	// Conditions are the conditions that can only be checked during the run.
+	Conditions []string `json:"conditions,omitempty"`
+	DependsOn  []string `json:"dependsOn,omitempty"`
+	// After is the path of the sibling the task would start after without depending on it, see Begin.
+	After string `json:"after,omitempty"`
+	// External is the function that would be compiled into a separate program and run.
+	External string `json:"external,omitempty"`
+	// Env holds the environment variables set for the task's commands on top of those of the
+	// builder process, with secrets masked.
+	Env      map[string]string `json:"env,omitempty"`
+	EnvError string            `json:"envError,omitempty"`
+	// Dir is the working directory of the task's commands, relative to the workspace root, if it is not the root.
+	Dir      string      `json:"dir,omitempty"`
+	Children []*PlanStep `json:"children,omitempty"`
+}
+
+// Plan works out what running the task would do, without running anything. Conditions that
+// depend on the outcome of other tasks cannot be checked, and are listed instead.
+func (t *Task) Plan() *PlanStep {
+	expandMatrices(t)
+	paths := map[*Task]string{}
+	walkTasks(t, "", func(t *Task, taskPath string, depth int) {
+		paths[t] = taskPath
+	})
+	order := 0
+	skipped := map[*Task]bool{}
+	var plan func(t *Task, taskPath string, concurrent bool, skipReason string, env map[string]string, dir string) *PlanStep
+	plan = func(t *Task, taskPath string, concurrent bool, skipReason string, env map[string]string, dir string) *PlanStep {
+		step := &PlanStep{
+			Name:         t.displayName(),
+			Path:         taskPath,
+			Kind:         t.kind,
+			CallLocation: t.callLocation,
+			Concurrent:   concurrent,
+		}
+		if skipReason == "" {
+			skipReason = t.deselectedReason()
+		}
+		if skipReason == "" {
+			for _, dep := range t.dependsOn {
+				if skipped[dep] {
+					skipReason = fmt.Sprintf("dependency %s would be skipped", dep.label())
+					break
+				}
+			}
+		}
+		if skipReason == "" {
+			for _, c := range t.conditions {
+				if c.dynamic {
+					step.Conditions = append(step.Conditions, c.description)
+				} else if !c.check() {
+					skipReason = fmt.Sprintf("condition '%s' is not met", c.description)
+					break
+				}
+			}
+		}
+		if skipReason != "" {
+			step.Skip = true
+			step.SkipReason = skipReason
+			skipped[t] = true
+		} else {
+			order++
+			step.Order = order
+		}
+		for _, dep := range t.dependsOn {
+			step.DependsOn = append(step.DependsOn, paths[dep])
+		}
+		if t.after != nil {
+			step.After = paths[t.after]
+		}
+		if t.dir != "" {
+			dir = t.dir
+		}
+		step.Dir = dir
+		if scoped, err := t.env.apply(env, false); err != nil {
+			step.EnvError = err.Error()
+		} else {
+			env = scoped
+		}
+		if len(env) > 0 {
+			step.Env = map[string]string{}
+			for k, v := range env {
+				step.Env[k] = masker.String(v)
+			}
+		}
+		if t.external != nil && t.external.funcInfo != nil {
+			step.External = t.external.funcInfo.String()
+		}
+		childSkipReason := ""
+		if step.Skip {
+			childSkipReason = fmt.Sprintf("%s would be skipped", t.label())
+		}
+		childrenConcurrent := t.kind == "parallel" || t.kind == "matrix" || t.kind == "graph"
+		hookConditions := map[*Task]string{}
+		for _, hook := range t.hooks.onSuccess {
+			hookConditions[hook] = t.label() + " succeeded"
+		}
+		for _, hook := range t.hooks.onFailure {
+			hookConditions[hook] = t.label() + " failed"
+		}
+		for _, child := range t.children {
+			concurrent := childrenConcurrent && child.after == nil
+			step.Children = append(step.Children, plan(child, taskPath+"/"+child.displayName(), concurrent, childSkipReason, env, dir))
+		}
+		for _, hook := range t.hooks.all() {
+			hookStep := plan(hook, taskPath+"/"+hook.displayName(), false, childSkipReason, env, dir)
+			hookStep.Hook = true
+			if c, ok := hookConditions[hook]; ok {
+				hookStep.Conditions = append([]string{c}, hookStep.Conditions...)
+			}
+			step.Children = append(step.Children, hookStep)
+		}
+		return step
+	}
+	return plan(t, t.displayName(), false, "", nil, "")
+}
+
+// Walk calls fn for the step and each of its descendants, depth first.
+func (p *PlanStep) Walk(fn func(p *PlanStep, depth int)) {
+	var walk func(p *PlanStep, depth int)
+	walk = func(p *PlanStep, depth int) {
+		fn(p, depth)
+		for _, child := range p.Children {
+			walk(child, depth+1)
+		}
+	}
+	walk(p, 0)
+}
+
+// Print writes the plan as an indented tree to w.
+func (p *PlanStep) Print(w io.Writer) error {
+	var err error
+	p.Walk(func(p *PlanStep, depth int) {
+		if err != nil {
+			return
+		}
+		line := strings.Repeat("  ", depth)
+		if p.Skip {
+			line += "   - "
+		} else {
+			line += fmt.Sprintf("%3d. ", p.Order)
+		}
+		line += fmt.Sprintf("%s [%s]", p.Name, p.Kind)
+		if p.Concurrent {
+			line += " (concurrent)"
+		}
+		if after := p.DependsOn; len(after) > 0 || p.After != "" {
+			if p.After != "" {
+				after = append(append([]string{}, after...), p.After)
+			}
+			line += " after " + strings.Join(after, ", ")
+		}
+		if p.Skip {
+			line += " skipped: " + p.SkipReason
+		}
+		for _, c := range p.Conditions {
+			line += " when " + c
+		}
+		if p.Dir != "" {
+			line += " in " + p.Dir
+		}
+		if p.External != "" {
+			line += " compiles " + p.External
+		}
+		if p.EnvError != "" {
+			line += " env error: " + p.EnvError
+		}
+		if len(p.Env) > 0 {
+			keys := make([]string, 0, len(p.Env))
+			for k := range p.Env {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			line += "\n" + strings.Repeat("  ", depth) + "     env:"
+			for _, k := range keys {
+				line += fmt.Sprintf(" %s=%q", k, p.Env[k])
+			}
+		}
+		_, err = fmt.Fprintln(w, line)
+	})
+	return errors.Trace(err)
+}
+
+// WriteJSON writes the plan as indented JSON to w.
+func (p *PlanStep) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return errors.Trace(encoder.Encode(p))
+}
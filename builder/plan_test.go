@@ -0,0 +1,109 @@
+package builder
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	os.Setenv("NANOCI_BRANCH", "feature")
+	defer os.Unsetenv("NANOCI_BRANCH")
+	build := Step("build", noop).Dir("src").Env("GOOS", "linux")
+	checks := Parallel(Step("lint", noop), Step("test", noop))
+	checks.name = "checks"
+	root := Stage("root",
+		build,
+		checks,
+		Stage("deploy", Step("push", noop)).When(OnBranch("main")),
+		Step("notify", noop).When(Failed(build)),
+	).Finally(Step("cleanup", noop))
+	plan := root.Plan()
+	steps := map[string]*PlanStep{}
+	plan.Walk(func(p *PlanStep, depth int) {
+		steps[p.Path] = p
+	})
+	tests := []struct {
+		path       string
+		order      int
+		concurrent bool
+		skip       string
+		conditions string
+		hook       bool
+	}{
+		{path: "root", order: 1},
+		{path: "root/build", order: 2},
+		{path: "root/checks", order: 3},
+		{path: "root/checks/lint", order: 4, concurrent: true},
+		{path: "root/checks/test", order: 5, concurrent: true},
+		{path: "root/deploy", skip: "condition 'branch is main' is not met"},
+		{path: "root/deploy/push", skip: "'deploy' would be skipped"},
+		{path: "root/notify", order: 6, conditions: "'build' failed"},
+		{path: "root/cleanup", order: 7, hook: true},
+	}
+	if len(steps) != len(tests) {
+		t.Errorf("got %d steps, want %d", len(steps), len(tests))
+	}
+	for _, test := range tests {
+		step, ok := steps[test.path]
+		if !ok {
+			t.Errorf("%s is not in the plan", test.path)
+			continue
+		}
+		if step.Order != test.order || step.Concurrent != test.concurrent || step.Hook != test.hook {
+			t.Errorf("%s: got order %d, concurrent %v, hook %v", test.path, step.Order, step.Concurrent, step.Hook)
+		}
+		if step.Skip != (test.skip != "") || !strings.Contains(step.SkipReason, test.skip) {
+			t.Errorf("%s: got skip %v (%s), want %q", test.path, step.Skip, step.SkipReason, test.skip)
+		}
+		if got := strings.Join(step.Conditions, ", "); got != test.conditions {
+			t.Errorf("%s: got conditions %q, want %q", test.path, got, test.conditions)
+		}
+	}
+	if step := steps["root/build"]; step.Dir != "src" || step.Env["GOOS"] != "linux" {
+		t.Errorf("build runs in %q with %v", step.Dir, step.Env)
+	}
+	if step := steps["root/checks"]; step.Dir != "" || len(step.Env) != 0 {
+		t.Errorf("the directory and environment of build leaked to checks: %q, %v", step.Dir, step.Env)
+	}
+	out := &bytes.Buffer{}
+	if err := plan.Print(out); err != nil {
+		t.Fatal(err)
+	}
+	want := `  1. root [stage]
+    2. build [step] in src
+       env: GOOS="linux"
+    3. checks [parallel]
+      4. lint [step] (concurrent)
+      5. test [step] (concurrent)
+     - deploy [stage] skipped: condition 'branch is main' is not met
+       - push [step] skipped: 'deploy' would be skipped
+    6. notify [step] when 'build' failed
+    7. cleanup [step]
+`
+	if out.String() != want {
+		t.Errorf("got plan\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestPlanGraph(t *testing.T) {
+	build := Step("build", noop)
+	test := Step("test", noop).DependsOn(build)
+	lint := Step("lint", noop).When(EnvSet("NANOCI_TEST_UNSET"))
+	release := Step("release", noop).DependsOn(test, lint)
+	root := Graph("root", release)
+	if err := resolveDependencies(root); err != nil {
+		t.Fatal(err)
+	}
+	steps := map[string]*PlanStep{}
+	root.Plan().Walk(func(p *PlanStep, depth int) {
+		steps[p.Name] = p
+	})
+	if step := steps["test"]; strings.Join(step.DependsOn, " ") != "root/build" || !step.Concurrent {
+		t.Errorf("test depends on %v, concurrent %v", step.DependsOn, step.Concurrent)
+	}
+	if step := steps["release"]; !step.Skip || step.SkipReason != "dependency 'lint' would be skipped" {
+		t.Errorf("release: got skip %v (%s)", step.Skip, step.SkipReason)
+	}
+}
@@ -0,0 +1,209 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Result is the outcome of running a task, along with the results of its children.
+type Result struct {
+	Name string `json:"name"`
+	// Path is the names of the task and its parents joined by slashes, e.g. "root/build/api".
+	Path         string            `json:"path"`
+	Kind         string            `json:"kind"`
+	CallLocation string            `json:"callLocation"`
+	Status       Status            `json:"status"`
+	SkipReason   string            `json:"skipReason,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Duration     time.Duration     `json:"duration"`
+	Error        string            `json:"error,omitempty"`
+	ErrorStack   string            `json:"errorStack,omitempty"`
+	Attempts     int               `json:"attempts"`
+	Cache        string            `json:"cache,omitempty"`
+	Outputs      map[string]string `json:"outputs,omitempty"`
+	DependsOn    []string          `json:"dependsOn,omitempty"`
+	Children     []*Result         `json:"children,omitempty"`
+	// After is the path of the sibling the task started after without depending on it, see Begin.
+	After string `json:"after,omitempty"`
+	// Hook is set for the tasks run after their parent by OnSuccess, OnFailure or Finally.
+	Hook bool `json:"hook,omitempty"`
+	// AttemptResults has the outcome of every attempt of a task with a retry policy.
+	AttemptResults []AttemptResult `json:"attemptResults,omitempty"`
+	// Output is everything the task's commands wrote to stdout and stderr.
+	Output string `json:"-"`
+}
+
+// Result returns the current result of the task and all of its children.
+func (t *Task) Result() *Result {
+	results := map[*Task]*Result{}
+	r := t.resultAt("", results)
+	for task, result := range results {
+		for _, dep := range task.dependsOn {
+			if depResult, ok := results[dep]; ok {
+				result.DependsOn = append(result.DependsOn, depResult.Path)
+			}
+		}
+		if afterResult, ok := results[task.after]; ok {
+			result.After = afterResult.Path
+		}
+	}
+	return r
+}
+
+// resultAt returns the result of the task, whose parent has the given path, adding the results
+// of the task and its descendants to results.
+func (t *Task) resultAt(parentPath string, results map[*Task]*Result) *Result {
+	t.mu.Lock()
+	r := &Result{
+		Name:         t.displayName(),
+		Path:         t.displayName(),
+		Kind:         t.kind,
+		CallLocation: t.callLocation,
+		Status:       t.status,
+		SkipReason:   t.skipReason,
+		Start:        t.started,
+		End:          t.ended,
+		Attempts:     t.attempts,
+		Cache:        t.cacheStatus,
+	}
+	if len(t.attemptResults) > 0 {
+		r.AttemptResults = append([]AttemptResult{}, t.attemptResults...)
+	}
+	if r.Status == "" {
+		r.Status = StatusPending
+	}
+	if parentPath != "" {
+		r.Path = parentPath + "/" + r.Name
+	}
+	if !t.started.IsZero() && !t.ended.IsZero() {
+		r.Duration = t.ended.Sub(t.started)
+	}
+	// Output was masked as it was written, the rest may contain secrets that were used in commands
+	if t.err != nil {
+		r.Error = masker.String(t.err.Error())
+		r.ErrorStack = masker.String(errors.ErrorStack(t.err))
+	}
+	r.SkipReason = masker.String(r.SkipReason)
+	r.Output = t.output.String()
+	if len(t.outputs) > 0 {
+		r.Outputs = map[string]string{}
+		for k, v := range t.outputs {
+			r.Outputs[k] = masker.String(v)
+		}
+	}
+	t.mu.Unlock()
+	for _, child := range t.children {
+		r.Children = append(r.Children, child.resultAt(r.Path, results))
+	}
+	for _, hook := range t.hooks.all() {
+		hookResult := hook.resultAt(r.Path, results)
+		hookResult.Hook = true
+		r.Children = append(r.Children, hookResult)
+	}
+	results[t] = r
+	return r
+}
+
+// subtasks returns the tasks that run as part of this one, followed by its hooks. For a graph
+// this includes the dependencies that were pulled in, see resolveDependencies.
+func (t *Task) subtasks() []*Task {
+	children := t.children
+	if hooks := t.hooks.all(); len(hooks) > 0 {
+		children = append(append([]*Task{}, children...), hooks...)
+	}
+	return children
+}
+
+// displayName is the task's name, or a description of it for tasks without one.
+func (t *Task) displayName() string {
+	if t.name != "" {
+		return t.name
+	}
+	kind := t.kind
+	if kind == "" {
+		kind = "task"
+	}
+	return fmt.Sprintf("%s@%s", kind, path.Base(t.callLocation))
+}
+
+// Failed reports whether the run failed.
+func (r *Result) Failed() bool {
+	return r.Status == StatusFailed
+}
+
+// Err returns an error describing the failure if the run failed, or nil.
+func (r *Result) Err() error {
+	if !r.Failed() {
+		return nil
+	}
+	return errors.Errorf("%s failed: %s", r.Name, r.Error)
+}
+
+// Find returns the result with the given path among r and its descendants, or nil if there is none.
+func (r *Result) Find(path string) *Result {
+	var found *Result
+	r.Walk(func(r *Result, depth int) {
+		if found == nil && r.Path == path {
+			found = r
+		}
+	})
+	return found
+}
+
+// Walk calls fn for the result and each of its descendants, depth first.
+// depth is 0 for the result Walk is called on.
+func (r *Result) Walk(fn func(r *Result, depth int)) {
+	r.walk(fn, 0)
+}
+
+func (r *Result) walk(fn func(r *Result, depth int), depth int) {
+	fn(r, depth)
+	for _, child := range r.Children {
+		child.walk(fn, depth+1)
+	}
+}
+
+// PrintSummary writes a table with the outcome of every task to w.
+func (r *Result) PrintSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tSTATUS\tDURATION\tATTEMPTS\tCACHE\tLOCATION")
+	r.Walk(func(r *Result, depth int) {
+		attempts := ""
+		if r.Attempts > 0 {
+			attempts = fmt.Sprint(r.Attempts)
+		}
+		status := string(r.Status)
+		if r.SkipReason != "" {
+			status += " (" + r.SkipReason + ")"
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\t%s\t%s\t%s\t%s\n", strings.Repeat("  ", depth), r.Name, status,
+			r.Duration.Round(time.Millisecond), attempts, r.Cache, r.CallLocation)
+	})
+	return errors.Trace(tw.Flush())
+}
+
+// WriteJSON writes the result as indented JSON to w.
+func (r *Result) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return errors.Trace(encoder.Encode(r))
+}
+
+// WriteJSONFile writes the result as indented JSON to the named file.
+func (r *Result) WriteJSONFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return errors.Annotatef(err, "failed to create result file '%s'", filename)
+	}
+	defer file.Close()
+	return errors.Annotatef(r.WriteJSON(file), "failed to write result file '%s'", filename)
+}
@@ -0,0 +1,111 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestResult(t *testing.T) {
+	StateDir(t.TempDir())
+	MaskValue("hunter2")
+	build := Step("build", func(ctx context.Context) error {
+		_, err := RunCommand(ctx, Command{Script: "echo compiling", NoTee: true})
+		return err
+	})
+	lint := Step("lint", func() error {
+		return errors.New("password hunter2 is too short")
+	}).NoFailOnError()
+	root := Stage("root",
+		build,
+		lint,
+		Step("docs", noop).When(EnvSet("NANOCI_TEST_UNSET")),
+		Step("test", noop).DependsOn(build),
+	)
+	if err := callTask(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	result := root.Result()
+	tests := []struct {
+		path, status, error, output, dependsOn string
+		attempts                               int
+	}{
+		{path: "root", status: "success", attempts: 1},
+		{path: "root/build", status: "success", output: "compiling\n", attempts: 1},
+		{path: "root/lint", status: "allowed-failure", error: "password *** is too short", attempts: 1},
+		{path: "root/docs", status: "skipped"},
+		{path: "root/test", status: "success", dependsOn: "root/build", attempts: 1},
+	}
+	for _, test := range tests {
+		r := result.Find(test.path)
+		if r == nil {
+			t.Errorf("%s is not in the result", test.path)
+			continue
+		}
+		if string(r.Status) != test.status || r.Attempts != test.attempts || !strings.HasSuffix(r.Error, test.error) {
+			t.Errorf("%s: got %s after %d attempts (%s), want %s after %d (%s)", test.path, r.Status, r.Attempts, r.Error, test.status, test.attempts, test.error)
+		}
+		if r.Output != test.output || strings.Join(r.DependsOn, " ") != test.dependsOn {
+			t.Errorf("%s: got output %q, depends on %v", test.path, r.Output, r.DependsOn)
+		}
+		if test.status != "skipped" && (r.Start.IsZero() || r.End.Before(r.Start) || r.Duration != r.End.Sub(r.Start)) {
+			t.Errorf("%s: ran from %s to %s, for %s", test.path, r.Start, r.End, r.Duration)
+		}
+	}
+	if strings.Contains(result.Find("root/lint").ErrorStack, "hunter2") {
+		t.Errorf("the secret is in the error stack")
+	}
+	if result.Failed() || result.Err() != nil {
+		t.Errorf("the run failed: %v", result.Err())
+	}
+	if result.Find("root/missing") != nil {
+		t.Errorf("found a task that does not exist")
+	}
+}
+
+func TestResultErr(t *testing.T) {
+	StateDir(t.TempDir())
+	root := Stage("root", Step("build", func() error {
+		return errors.New("does not compile")
+	}))
+	if err := callTask(context.Background(), root); err == nil {
+		t.Fatal("the run did not fail")
+	}
+	result := root.Result()
+	if !result.Failed() || result.Err() == nil || !strings.Contains(result.Err().Error(), "root failed: ") {
+		t.Errorf("got %v for a failed run", result.Err())
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	result := &Result{Name: "root", Kind: "stage", Status: StatusFailed, Attempts: 1, CallLocation: "ci/main.go:10", Children: []*Result{
+		{Name: "build", Kind: "step", Status: StatusSuccess, Attempts: 2, Cache: CacheMiss, CallLocation: "ci/main.go:11"},
+		{Name: "deploy", Kind: "step", Status: StatusSkipped, SkipReason: "branch is not main", CallLocation: "ci/main.go:12"},
+	}}
+	out := &bytes.Buffer{}
+	if err := result.PrintSummary(out); err != nil {
+		t.Fatal(err)
+	}
+	want := `TASK      STATUS                        DURATION  ATTEMPTS  CACHE  LOCATION
+root      failed                        0s        1                ci/main.go:10
+  build   success                       0s        2         miss   ci/main.go:11
+  deploy  skipped (branch is not main)  0s                         ci/main.go:12
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestResultJSON(t *testing.T) {
+	result := &Result{Name: "root", Path: "root", Kind: "stage", Status: StatusSuccess, Output: "not in the JSON"}
+	out := &bytes.Buffer{}
+	if err := result.WriteJSON(out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "not in the JSON") || !strings.Contains(out.String(), `"status": "success"`) {
+		t.Errorf("got %s", out)
+	}
+}
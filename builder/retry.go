@@ -0,0 +1,165 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RetryPolicy describes how a failed task is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times the task is run, including the first attempt.
+	MaxAttempts int
+	// Delay is the time to wait before the first retry.
+	Delay time.Duration
+	// Exponential doubles the delay after every retry, up to MaxDelay if it is set.
+	Exponential bool
+	MaxDelay    time.Duration
+	// Jitter randomly varies each delay by up to this fraction of it, e.g. 0.2 for ±20%.
+	Jitter float64
+	// If decides whether a failed attempt is retried. When nil, every failure is retried.
+	If RetryCondition
+}
+
+// RetryCondition decides whether a failed attempt should be retried, given the error it returned
+// and everything its shell commands wrote to stderr.
+type RetryCondition func(err error, stderr string) bool
+
+// RetryOnError retries only when the error returned by the task satisfies fn.
+func RetryOnError(fn func(error) bool) RetryCondition {
+	return func(err error, stderr string) bool {
+		return fn(err)
+	}
+}
+
+// RetryOnStderr retries only when the stderr of the failed attempt matches the regular expression.
+func RetryOnStderr(pattern string) RetryCondition {
+	re := regexp.MustCompile(pattern)
+	return func(err error, stderr string) bool {
+		return re.MatchString(stderr)
+	}
+}
+
+// Retry runs the task again according to policy when it fails.
+func (t *Task) Retry(policy RetryPolicy) *Task {
+	t.retry = &policy
+	return t
+}
+
+// delay returns how long to wait before the given retry, where retry 1 follows the first attempt.
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	d := p.Delay
+	if p.Exponential {
+		for i := 1; i < retry; i++ {
+			d *= 2
+			if p.MaxDelay > 0 && d >= p.MaxDelay {
+				d = p.MaxDelay
+				break
+			}
+		}
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// runWithRetries calls attempt until it succeeds or the task's retry policy gives up.
+func (t *Task) runWithRetries(ctx context.Context, attempt func(context.Context) error) error {
+	policy := t.retry
+	if policy == nil || policy.MaxAttempts <= 1 {
+		t.setAttempts(1)
+		return attempt(ctx)
+	}
+	for n := 1; ; n++ {
+		rec := &stderrRecorder{}
+		t.setAttempts(n)
+		start := time.Now()
+		err := attempt(context.WithValue(ctx, stderrRecorderKey, rec))
+		t.recordAttempt(start, err)
+		if err == nil {
+			if n > 1 {
+				log.Info().Msgf("%s succeeded on attempt %d of %d", t.label(), n, policy.MaxAttempts)
+			}
+			return nil
+		}
+		if n >= policy.MaxAttempts {
+			return errors.Annotatef(err, "%s failed after %d attempts", t.label(), n)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if policy.If != nil && !policy.If(err, rec.String()) {
+			log.Warn().Msgf("Attempt %d of %s failed and will not be retried: %s", n, t.label(), err)
+			return err
+		}
+		wait := policy.delay(n)
+		log.Warn().Msgf("Attempt %d of %d of %s failed, retrying in %s: %s", n, policy.MaxAttempts, t.label(), wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return errors.Annotatef(err, "%s was cancelled while waiting to retry", t.label())
+		}
+	}
+}
+
+func (t *Task) setAttempts(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts = n
+}
+
+// AttemptResult is the outcome of one attempt of a task with a retry policy.
+type AttemptResult struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// recordAttempt records the outcome of an attempt that started at start.
+func (t *Task) recordAttempt(start time.Time, err error) {
+	attempt := AttemptResult{Start: start, Duration: time.Since(start)}
+	if err != nil {
+		attempt.Error = masker.String(err.Error())
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attemptResults = append(t.attemptResults, attempt)
+}
+
+// recordStderr returns a writer that passes a command's stderr on to w, and to the stderr recorder
+// of the current attempt if there is one, whether or not the stderr is shown.
+func recordStderr(ctx context.Context, w io.Writer) io.Writer {
+	if rec, ok := ctx.Value(stderrRecorderKey).(*stderrRecorder); ok {
+		return io.MultiWriter(w, rec)
+	}
+	return w
+}
+
+// stderrRecorder collects the stderr of every shell command run during one attempt of a task.
+type stderrRecorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *stderrRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *stderrRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.String()
+}
@@ -0,0 +1,110 @@
+package builder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		delays []time.Duration
+	}{
+		{RetryPolicy{Delay: time.Second}, []time.Duration{time.Second, time.Second, time.Second}},
+		{RetryPolicy{Delay: time.Second, Exponential: true}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{RetryPolicy{Delay: time.Second, Exponential: true, MaxDelay: 3 * time.Second}, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}},
+		{RetryPolicy{}, []time.Duration{0, 0}},
+	}
+	for _, test := range tests {
+		for i, want := range test.delays {
+			if got := test.policy.delay(i + 1); got != want {
+				t.Errorf("%+v: retry %d waits %s, want %s", test.policy, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	policy := RetryPolicy{Delay: time.Second, Jitter: 0.2}
+	varied := false
+	for i := 0; i < 100; i++ {
+		d := policy.delay(1)
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("delay %s is not within 20%% of 1s", d)
+		}
+		if d != time.Second {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Errorf("jitter did not vary the delay")
+	}
+}
+
+func TestRunWithRetries(t *testing.T) {
+	task := Step("flaky", noop).Retry(RetryPolicy{MaxAttempts: 5, Delay: time.Millisecond})
+	calls := 0
+	err := task.runWithRetries(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.Errorf("attempt %d failed", calls)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := task.Result()
+	if r.Attempts != 3 || len(r.AttemptResults) != 3 {
+		t.Fatalf("got %d attempts and %d attempt results, want 3", r.Attempts, len(r.AttemptResults))
+	}
+	for i, want := range []string{"attempt 1 failed", "attempt 2 failed", ""} {
+		attempt := r.AttemptResults[i]
+		if attempt.Error != want {
+			t.Errorf("attempt %d: got error %q, want %q", i+1, attempt.Error, want)
+		}
+		if attempt.Start.IsZero() || (i > 0 && !attempt.Start.After(r.AttemptResults[i-1].Start)) {
+			t.Errorf("attempt %d: start %s is not recorded in order", i+1, attempt.Start)
+		}
+	}
+}
+
+func TestRunWithRetriesGivesUp(t *testing.T) {
+	task := Step("broken", noop).Retry(RetryPolicy{MaxAttempts: 2})
+	calls := 0
+	err := task.runWithRetries(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errors.New("broken")
+	})
+	if err == nil || calls != 2 {
+		t.Errorf("got error %v after %d calls, want an error after 2", err, calls)
+	}
+
+	task = Step("fatal", noop).Retry(RetryPolicy{MaxAttempts: 3, If: RetryOnError(func(err error) bool {
+		return !errors.IsNotValid(err)
+	})})
+	calls = 0
+	err = task.runWithRetries(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errors.NotValidf("configuration")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("got error %v after %d calls, want an error after 1", err, calls)
+	}
+	if r := task.Result(); len(r.AttemptResults) != 1 {
+		t.Errorf("got %d attempt results, want 1", len(r.AttemptResults))
+	}
+}
+
+func TestRunWithoutRetryPolicy(t *testing.T) {
+	task := Step("once", noop)
+	if err := task.runWithRetries(context.Background(), func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if r := task.Result(); r.Attempts != 1 || r.AttemptResults != nil {
+		t.Errorf("got %d attempts and %v attempt results, want 1 attempt and none recorded", r.Attempts, r.AttemptResults)
+	}
+}
@@ -0,0 +1,95 @@
+package builder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// currentRun identifies the current run of the pipeline and where its data is kept.
+var currentRun struct {
+	sync.Mutex
+	id       string
+	dir      string
+	stateDir string
+}
+
+// StateDir sets the directory NanoCI keeps the data of each run in, such as its artifacts.
+// It defaults to $NANOCI_STATE_DIR, or .nanoci in the working directory.
+func StateDir(dir string) {
+	currentRun.Lock()
+	defer currentRun.Unlock()
+	currentRun.stateDir = dir
+}
+
+func stateDir() string {
+	if currentRun.stateDir != "" {
+		return currentRun.stateDir
+	}
+	if dir := os.Getenv("NANOCI_STATE_DIR"); dir != "" {
+		return dir
+	}
+	return ".nanoci"
+}
+
+// runsDir returns the directory containing the directories of all runs.
+func runsDir() string {
+	currentRun.Lock()
+	defer currentRun.Unlock()
+	return filepath.Join(stateDir(), "runs")
+}
+
+// NewRunID returns a unique ID for a run that sorts by the time the run started.
+func NewRunID() string {
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// startRun begins a new run with its own directory. The run's ID can be chosen by whatever
+// started the builder, such as `nanoci serve`, with $NANOCI_RUN_ID.
+func startRun() error {
+	currentRun.Lock()
+	defer currentRun.Unlock()
+	currentRun.id = os.Getenv("NANOCI_RUN_ID")
+	if currentRun.id == "" {
+		currentRun.id = NewRunID()
+	}
+	dir, err := filepath.Abs(filepath.Join(stateDir(), "runs", currentRun.id))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	currentRun.dir = dir
+	return errors.Annotatef(os.MkdirAll(currentRun.dir, 0755), "failed to create run directory")
+}
+
+// RunID returns the ID of the current run.
+func RunID() string {
+	currentRun.Lock()
+	defer currentRun.Unlock()
+	return currentRun.id
+}
+
+// RunDir returns the directory of the current run.
+func RunDir() string {
+	currentRun.Lock()
+	defer currentRun.Unlock()
+	return currentRun.dir
+}
+
+// currentRunDir returns the directory of the current run, starting a run if there is none yet,
+// e.g. when tasks are run without Begin.
+func currentRunDir() (string, error) {
+	if dir := RunDir(); dir != "" {
+		return dir, nil
+	}
+	if err := startRun(); err != nil {
+		return "", err
+	}
+	return RunDir(), nil
+}
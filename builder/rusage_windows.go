@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package builder
+
+import "os"
+
+// maxRSS is not known on Windows.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
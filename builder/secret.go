@@ -0,0 +1,50 @@
+package builder
+
+import (
+	"sync"
+
+	"github.com/homelabtools/nanoci/secrets"
+	"github.com/juju/errors"
+)
+
+// masker masks the values of secrets in command output, logs and results.
+var masker = &secrets.Masker{}
+
+var secretStore struct {
+	once  sync.Once
+	store *secrets.Store
+	err   error
+}
+
+// Secret returns the value of a secret from the encrypted secrets file, see `nanoci secrets`.
+// From then on the value is masked in the output of commands, in logs and in results.
+func Secret(name string) (string, error) {
+	secretStore.once.Do(func() {
+		secretStore.store, secretStore.err = secrets.OpenDefault()
+	})
+	if secretStore.err != nil {
+		return "", errors.Annotatef(secretStore.err, "unable to open secrets")
+	}
+	value, ok := secretStore.store.Get(name)
+	if !ok {
+		return "", errors.NotFoundf("secret '%s'", name)
+	}
+	masker.Add(value)
+	return value, nil
+}
+
+// MustSecret is like Secret but panics if the secret cannot be read. Within a task the panic
+// fails the task.
+func MustSecret(name string) string {
+	value, err := Secret(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// MaskValue masks values that did not come from Secret, e.g. tokens read from elsewhere, in the
+// output of commands, in logs and in results.
+func MaskValue(values ...string) {
+	masker.Add(values...)
+}
@@ -0,0 +1,206 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// WebhookSink POSTs notifications as JSON to a URL, with the title, the body and the run summary
+// in the fields "title", "message" and "run".
+type WebhookSink struct {
+	URL string
+	// Headers are added to the request, e.g. for authentication.
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// Send implements Sink.
+func (s *WebhookSink) Send(ctx context.Context, m *Message) error {
+	body, err := json.Marshal(struct {
+		Title   string      `json:"title"`
+		Message string      `json:"message"`
+		Run     *RunSummary `json:"run"`
+	}{m.Title, m.Body, m.Run})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+	return errors.Trace(sendRequest(ctx, s.Client, req))
+}
+
+// NtfySink pushes notifications to an ntfy topic.
+type NtfySink struct {
+	// URL is that of the topic, e.g. https://ntfy.sh/my-builds.
+	URL string
+	// Token is an access token, if the topic needs one.
+	Token  string
+	Client *http.Client
+}
+
+// Send implements Sink. Failures are sent with high priority.
+func (s *NtfySink) Send(ctx context.Context, m *Message) error {
+	req, err := http.NewRequest(http.MethodPost, s.URL, strings.NewReader(m.Body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", m.Title))
+	if m.Run.Status == StatusFailed {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "rotating_light")
+	} else {
+		req.Header.Set("Tags", "white_check_mark")
+	}
+	if m.Run.URL != "" {
+		req.Header.Set("Click", m.Run.URL)
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	return errors.Trace(sendRequest(ctx, s.Client, req))
+}
+
+// GotifySink pushes notifications to a Gotify server.
+type GotifySink struct {
+	// URL is the root of the server, e.g. https://gotify.example.com.
+	URL string
+	// Token is the token of the application the messages are sent as.
+	Token  string
+	Client *http.Client
+}
+
+// Send implements Sink. Failures are sent with high priority.
+func (s *GotifySink) Send(ctx context.Context, m *Message) error {
+	message := map[string]interface{}{"title": m.Title, "message": m.Body, "priority": 5}
+	if m.Run.Status == StatusFailed {
+		message["priority"] = 8
+	}
+	if m.Run.URL != "" {
+		message["extras"] = map[string]interface{}{
+			"client::notification": map[string]interface{}{"click": map[string]string{"url": m.Run.URL}},
+		}
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", s.Token)
+	return errors.Trace(sendRequest(ctx, s.Client, req))
+}
+
+// sendRequest sends a notification request, failing unless the response is a success.
+func sendRequest(ctx context.Context, client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// EmailSink sends notifications by email. The connection is upgraded with STARTTLS when the
+// server offers it; the username and password are only sent over TLS or to localhost.
+type EmailSink struct {
+	// Addr is the host and port of the SMTP server, e.g. mail.example.com:587.
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Send implements Sink.
+func (s *EmailSink) Send(ctx context.Context, m *Message) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return errors.NotValidf("SMTP server address '%s'", s.Addr)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return errors.Annotatef(err, "STARTTLS failed")
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return errors.Annotatef(err, "SMTP authentication failed")
+		}
+	}
+	if err := client.Mail(s.From); err != nil {
+		return errors.Trace(err)
+	}
+	for _, to := range s.To {
+		if err := client.Rcpt(to); err != nil {
+			return errors.Annotatef(err, "recipient %s was refused", to)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := w.Write(s.email(m)); err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(client.Quit())
+}
+
+// email formats a message as a plain text email.
+func (s *EmailSink) email(m *Message) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Title))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,213 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// received is a request a test server got.
+type received struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+// testServer starts a server recording the requests it is sent, answering with code.
+func testServer(t *testing.T, code int) (*httptest.Server, *[]received) {
+	requests := []received{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, received{path: r.URL.Path, header: r.Header, body: string(body)})
+		w.WriteHeader(code)
+		w.Write([]byte("quota exceeded\n"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func testMessage(status Status) *Message {
+	return &Message{
+		Title: "nanoci (main) failed ✗",
+		Body:  "Run 20260101-100000-abcdef failed\nroot/test: 3 tests failed",
+		Run:   &RunSummary{RunRecord: &RunRecord{ID: "20260101-100000-abcdef", Status: status}, URL: "https://ci.example.com/runs/1"},
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	server, requests := testServer(t, http.StatusNoContent)
+	sink := &WebhookSink{URL: server.URL + "/hooks/ci", Headers: map[string]string{"Authorization": "Bearer t0ken"}}
+	if err := sink.Send(context.Background(), testMessage(StatusFailed)); err != nil {
+		t.Fatal(err)
+	}
+	r := (*requests)[0]
+	payload := struct {
+		Title   string `json:"title"`
+		Message string `json:"message"`
+		Run     struct {
+			ID     string `json:"id"`
+			Status Status `json:"status"`
+			URL    string `json:"url"`
+		} `json:"run"`
+	}{}
+	if err := json.Unmarshal([]byte(r.body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if r.path != "/hooks/ci" || r.header.Get("Authorization") != "Bearer t0ken" || r.header.Get("Content-Type") != "application/json" {
+		t.Errorf("got request to %s with headers %v", r.path, r.header)
+	}
+	if payload.Title != "nanoci (main) failed ✗" || !strings.HasPrefix(payload.Message, "Run ") || payload.Run.Status != StatusFailed || payload.Run.URL != "https://ci.example.com/runs/1" {
+		t.Errorf("got payload %+v", payload)
+	}
+}
+
+func TestNtfySink(t *testing.T) {
+	server, requests := testServer(t, http.StatusOK)
+	sink := &NtfySink{URL: server.URL + "/builds", Token: "tk_secret"}
+	for _, status := range []Status{StatusFailed, StatusSuccess} {
+		if err := sink.Send(context.Background(), testMessage(status)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed, succeeded := (*requests)[0], (*requests)[1]
+	if failed.path != "/builds" || failed.body != testMessage(StatusFailed).Body {
+		t.Errorf("got request to %s with body %q", failed.path, failed.body)
+	}
+	if title := failed.header.Get("Title"); title != "=?utf-8?q?nanoci_(main)_failed_=E2=9C=97?=" {
+		t.Errorf("got title %q", title)
+	}
+	if failed.header.Get("Priority") != "high" || failed.header.Get("Click") != "https://ci.example.com/runs/1" || failed.header.Get("Authorization") != "Bearer tk_secret" {
+		t.Errorf("got headers %v for a failure", failed.header)
+	}
+	if succeeded.header.Get("Priority") != "" || succeeded.header.Get("Tags") != "white_check_mark" {
+		t.Errorf("got headers %v for a success", succeeded.header)
+	}
+}
+
+func TestGotifySink(t *testing.T) {
+	server, requests := testServer(t, http.StatusOK)
+	sink := &GotifySink{URL: server.URL + "/", Token: "app-token"}
+	if err := sink.Send(context.Background(), testMessage(StatusFailed)); err != nil {
+		t.Fatal(err)
+	}
+	r := (*requests)[0]
+	payload := struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+		Extras   map[string]map[string]map[string]string
+	}{}
+	if err := json.Unmarshal([]byte(r.body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if r.path != "/message" || r.header.Get("X-Gotify-Key") != "app-token" {
+		t.Errorf("got request to %s with headers %v", r.path, r.header)
+	}
+	if payload.Priority != 8 || payload.Title != "nanoci (main) failed ✗" || payload.Extras["client::notification"]["click"]["url"] != "https://ci.example.com/runs/1" {
+		t.Errorf("got payload %+v", payload)
+	}
+}
+
+func TestSinkFailure(t *testing.T) {
+	server, _ := testServer(t, http.StatusTooManyRequests)
+	sink := &WebhookSink{URL: strings.Replace(server.URL, "http://", "http://user:password@", 1)}
+	err := sink.Send(context.Background(), testMessage(StatusSuccess))
+	if err == nil || !strings.Contains(err.Error(), "429 Too Many Requests: quota exceeded") {
+		t.Errorf("got error %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "password") {
+		t.Errorf("the error reveals the password in the URL: %s", err)
+	}
+}
+
+// smtpServer accepts one SMTP session, refusing mail to refused@example.com, and returns what
+// the session sent as DATA.
+func smtpServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	data := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		mail := &strings.Builder{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				data <- mail.String()
+				return
+			}
+			command := strings.ToUpper(strings.Fields(line + " x")[0])
+			switch {
+			case command == "EHLO":
+				reply("250-localhost\r\n250 8BITMIME")
+			case command == "RCPT" && strings.Contains(line, "refused@"):
+				reply("550 no such user")
+			case command == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					mail.WriteString(line)
+				}
+				reply("250 queued")
+			case command == "QUIT":
+				reply("221 bye")
+				data <- mail.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), data
+}
+
+func TestEmailSink(t *testing.T) {
+	addr, data := smtpServer(t)
+	sink := &EmailSink{Addr: addr, From: "ci@example.com", To: []string{"dev@example.com", "ops@example.com"}}
+	if err := sink.Send(context.Background(), testMessage(StatusFailed)); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-data
+	for _, want := range []string{
+		"From: ci@example.com\r\n",
+		"To: dev@example.com, ops@example.com\r\n",
+		"Subject: =?utf-8?q?nanoci_(main)_failed_=E2=9C=97?=\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nRun 20260101-100000-abcdef failed\r\nroot/test: 3 tests failed\r\n",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("the email does not contain %q:\n%s", want, mail)
+		}
+	}
+}
+
+func TestEmailSinkRefused(t *testing.T) {
+	addr, _ := smtpServer(t)
+	sink := &EmailSink{Addr: addr, From: "ci@example.com", To: []string{"refused@example.com"}}
+	err := sink.Send(context.Background(), testMessage(StatusFailed))
+	if err == nil || !strings.Contains(err.Error(), "recipient refused@example.com was refused") {
+		t.Errorf("got error %v", err)
+	}
+	sink.Addr = "no port"
+	if err := sink.Send(context.Background(), testMessage(StatusFailed)); err == nil || !strings.Contains(err.Error(), "SMTP server address 'no port' not valid") {
+		t.Errorf("got error %v for an invalid address", err)
+	}
+}
@@ -0,0 +1,148 @@
+package builder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Status is the state of a task within a run.
+type Status string
+
+// The states a task can be in. A task is pending until it starts and ends up in one of the other states.
+const (
+	StatusPending        Status = "pending"
+	StatusRunning        Status = "running"
+	StatusSuccess        Status = "success"
+	StatusFailed         Status = "failed"
+	StatusSkipped        Status = "skipped"
+	StatusAllowedFailure Status = "allowed-failure"
+)
+
+// Status returns the current state of the task.
+func (t *Task) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status == "" {
+		return StatusPending
+	}
+	return t.status
+}
+
+// SkipReason returns why the task was skipped, or an empty string if it was not.
+func (t *Task) SkipReason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.skipReason
+}
+
+// begin marks the task as running.
+func (t *Task) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = StatusRunning
+	t.started = time.Now()
+}
+
+// startTime returns when the task started, or the zero time if it has not.
+func (t *Task) startTime() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.started
+}
+
+// endTime returns when the task finished, or the zero time if it has not.
+func (t *Task) endTime() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ended
+}
+
+// doneChan returns a channel that is closed once the task has finished or was skipped.
+func (t *Task) doneChan() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	return t.done
+}
+
+// markDone closes the task's done channel. t.mu must be held.
+func (t *Task) markDone() {
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+}
+
+// skip marks the task as skipped for the given reason.
+func (t *Task) skip(reason string) {
+	t.mu.Lock()
+	t.status = StatusSkipped
+	t.skipReason = reason
+	t.markDone()
+	t.mu.Unlock()
+	log.Warn().Msgf("Skipping %s: %s", t.label(), reason)
+	t.skipDescendants(fmt.Sprintf("%s was skipped", t.label()))
+}
+
+// skipDescendants marks the tasks inside t that have not run as skipped, without logging each of them.
+func (t *Task) skipDescendants(reason string) {
+	for _, child := range t.subtasks() {
+		child.mu.Lock()
+		if child.status == "" {
+			child.status = StatusSkipped
+			child.skipReason = reason
+			child.markDone()
+		}
+		child.mu.Unlock()
+		child.skipDescendants(reason)
+	}
+}
+
+// skipUnstarted marks the children of t that never started as skipped, e.g. because t was
+// restored from the cache, so that tasks depending on them do not wait forever.
+func (t *Task) skipUnstarted(reason string) {
+	for _, child := range t.children {
+		child.mu.Lock()
+		unstarted := child.status == ""
+		if unstarted {
+			child.status = StatusSkipped
+			child.skipReason = reason
+			child.markDone()
+		}
+		child.mu.Unlock()
+		if unstarted {
+			child.skipDescendants(reason)
+		}
+	}
+}
+
+// finish records the outcome of running the task.
+func (t *Task) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended = time.Now()
+	t.err = err
+	defer t.markDone()
+	switch {
+	case err == nil:
+		t.status = StatusSuccess
+	case t.noFailOnError:
+		t.status = StatusAllowedFailure
+	default:
+		t.status = StatusFailed
+	}
+}
+
+// succeeded reports whether the task finished without failing the pipeline.
+func (t *Task) succeeded() bool {
+	status := t.Status()
+	return status == StatusSuccess || status == StatusAllowedFailure
+}
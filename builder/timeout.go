@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// pipeline holds settings that apply to the whole workflow started by Begin.
+var pipeline struct {
+	timeout           time.Duration
+	inactivityTimeout time.Duration
+	hooks             hooks
+	hookTimeout       time.Duration
+	env               envScope
+	dir               string
+}
+
+// PipelineTimeout limits how long the whole workflow started by Begin may run.
+func PipelineTimeout(d time.Duration) {
+	pipeline.timeout = d
+}
+
+// PipelineInactivityTimeout fails the workflow started by Begin if no task produces output for the given duration.
+func PipelineInactivityTimeout(d time.Duration) {
+	pipeline.inactivityTimeout = d
+}
+
+// Timeout limits how long a task may run. When the time is up the context passed to the task
+// is cancelled, which kills any commands it started with SHContext. Each attempt of a task
+// with a retry policy gets the full timeout.
+func (t *Task) Timeout(d time.Duration) *Task {
+	t.timeout = d
+	return t
+}
+
+// InactivityTimeout fails a task if its commands produce no output for the given duration.
+func (t *Task) InactivityTimeout(d time.Duration) *Task {
+	t.inactivityTimeout = d
+	return t
+}
+
+type contextKey int
+
+const (
+	watchdogKey contextKey = iota
+	stderrRecorderKey
+	taskKey
+	envKey
+	dirKey
+	groupKey
+	abortKey
+)
+
+// watchdog cancels a context when it has not been touched for a while.
+// Watchdogs of nested tasks are chained so that output resets all of them.
+type watchdog struct {
+	parent  *watchdog
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+	fired   int32
+}
+
+func withWatchdog(ctx context.Context, timeout time.Duration) (context.Context, *watchdog) {
+	ctx, cancel := context.WithCancel(ctx)
+	wd := &watchdog{timeout: timeout, cancel: cancel}
+	wd.parent, _ = ctx.Value(watchdogKey).(*watchdog)
+	wd.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&wd.fired, 1)
+		cancel()
+	})
+	return context.WithValue(ctx, watchdogKey, wd), wd
+}
+
+// touch records activity, restarting the timers of this watchdog and all of its parents.
+func (wd *watchdog) touch() {
+	for ; wd != nil; wd = wd.parent {
+		if !wd.expired() {
+			wd.timer.Reset(wd.timeout)
+		}
+	}
+}
+
+func (wd *watchdog) stop() {
+	wd.timer.Stop()
+	wd.cancel()
+}
+
+func (wd *watchdog) expired() bool {
+	return atomic.LoadInt32(&wd.fired) == 1
+}
+
+// activityWriter wraps w so that every write counts as activity for the watchdogs in ctx.
+func activityWriter(ctx context.Context, w io.Writer) io.Writer {
+	wd, ok := ctx.Value(watchdogKey).(*watchdog)
+	if !ok {
+		return w
+	}
+	return &watchdogWriter{w: w, wd: wd}
+}
+
+type watchdogWriter struct {
+	w  io.Writer
+	wd *watchdog
+}
+
+func (w *watchdogWriter) Write(p []byte) (int, error) {
+	w.wd.touch()
+	return w.w.Write(p)
+}
@@ -0,0 +1,64 @@
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	StateDir(t.TempDir())
+	task := Step("hang", func(ctx context.Context) error {
+		_, _, err := SHContext(ctx, "sleep 30")
+		return err
+	}).Timeout(100 * time.Millisecond)
+	start := time.Now()
+	err := callTask(context.Background(), task)
+	if err == nil || !strings.Contains(err.Error(), "'hang' timed out after 100ms") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the command was not killed, the task took %s", elapsed)
+	}
+}
+
+func TestTimeoutPerAttempt(t *testing.T) {
+	StateDir(t.TempDir())
+	attempts := 0
+	task := Step("slow start", func(ctx context.Context) error {
+		attempts++
+		if attempts == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}).Timeout(50 * time.Millisecond).Retry(RetryPolicy{MaxAttempts: 2})
+	if err := callTask(context.Background(), task); err != nil {
+		t.Errorf("the second attempt did not get its own timeout: %s", err)
+	}
+}
+
+func TestInactivityTimeout(t *testing.T) {
+	StateDir(t.TempDir())
+	tests := []struct {
+		script string
+		error  string
+	}{
+		{script: "for i in 1 2 3 4 5 6; do echo $i; sleep 0.1; done"},
+		{script: "echo started; sleep 30", error: "'quiet' produced no output for 300ms"},
+	}
+	for _, test := range tests {
+		task := Step("quiet", func(ctx context.Context) error {
+			_, err := RunCommand(ctx, Command{Script: test.script, NoTee: true})
+			return err
+		}).InactivityTimeout(300 * time.Millisecond)
+		err := callTask(context.Background(), task)
+		if test.error == "" && err != nil {
+			t.Errorf("%s: output did not keep the task alive: %s", test.script, err)
+		}
+		if test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)) {
+			t.Errorf("%s: got error %v, want %q", test.script, err, test.error)
+		}
+	}
+}
@@ -166,7 +166,7 @@ func compile(sourceDirectory, binName string) error {
 			line := scanner.Text()
 			_, err := newFile.WriteString(line + "\n")
 			if err != nil {
-				return errors.Annotatef(err, "failed writing post-processed source file '%s', filename")
+				return errors.Annotatef(err, "failed writing post-processed source file '%s'", filename)
 			}
 		}
 	}
@@ -218,3 +218,27 @@ func copyBuilderModule(sourceDir, destDir string) error {
 	}
 	return nil
 }
+
+// BuildModule compiles the Go module in sourceDir, such as the builder module of a repository,
+// into a program at binPath, which is relative to sourceDir unless it is absolute.
+func BuildModule(sourceDir, binPath string) (*Program, error) {
+	dir, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !filepath.IsAbs(binPath) {
+		binPath = filepath.Join(dir, binPath)
+	}
+	cmd := exec.Command("go", "build", "-o", binPath, ".")
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to compile module in '%s':\n%s", dir, output)
+	}
+	log.Debug().Msgf("built module '%s' into '%s'", dir, binPath)
+	return &Program{
+		Directory:   dir,
+		BinFileName: filepath.Base(binPath),
+		FullPath:    binPath,
+	}, nil
+}
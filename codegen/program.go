@@ -2,11 +2,14 @@ package codegen
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"os"
 	"os/exec"
 
 	"github.com/homelabtools/nanoci/mirror"
+	"github.com/homelabtools/nanoci/proc"
 	"github.com/juju/errors"
 	"github.com/rs/zerolog/log"
 )
@@ -18,6 +21,15 @@ type Program struct {
 	BinFileName string
 	FullPath    string
 	Directory   string
+	// Stdout and Stderr receive the program's output, they default to os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Env is the environment of the program, it defaults to that of the current process.
+	Env []string
+	// WorkDir is the working directory of the program, it defaults to that of the current process.
+	WorkDir string
+	// Args are the command line arguments of the program.
+	Args []string
 }
 
 // Remove cleans up the program and deletes it from disk.
@@ -30,13 +42,27 @@ func (p *Program) Remove() {
 
 // Run runs the program and blocks until it is completed.
 func (p *Program) Run(args interface{}) error {
+	return p.RunContext(context.Background(), args)
+}
+
+// RunContext runs the program and blocks until it is completed.
+// The program and any processes it started are killed if ctx is done first.
+func (p *Program) RunContext(ctx context.Context, args interface{}) error {
 	argData, err := json.Marshal(args)
 	if err != nil {
 		return errors.Annotatef(err, "failed to marshal args for generated program")
 	}
-	cmd := exec.Command(p.FullPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := exec.Command(p.FullPath, p.Args...)
+	cmd.Stdout = p.Stdout
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = p.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
 	cmd.Stdin = bytes.NewReader(argData)
-	return cmd.Run()
+	cmd.Env = p.Env
+	cmd.Dir = p.WorkDir
+	return proc.Run(ctx, cmd)
 }
@@ -0,0 +1,108 @@
+// Package forge reports the outcome of pipelines to forges such as Gitea and GitHub as commit statuses.
+package forge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// State is the state of a commit status, the forges share these.
+type State string
+
+const (
+	StatePending State = "pending"
+	StateSuccess State = "success"
+	StateFailure State = "failure"
+	// StateError means the pipeline could not be run at all.
+	StateError State = "error"
+)
+
+// Status is a commit status. Forges keep one status per commit and context, so setting a status
+// with the same context again replaces the previous one.
+type Status struct {
+	Context     string `json:"context"`
+	State       State  `json:"state"`
+	Description string `json:"description,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+}
+
+// Reporter sets commit statuses on a forge.
+type Reporter interface {
+	// SetStatus sets a status of a commit in a repository, given by its full name, e.g. "owner/name".
+	SetStatus(ctx context.Context, repo, commit string, status Status) error
+}
+
+// GitHub sets commit statuses through the GitHub REST API.
+type GitHub struct {
+	// APIURL is the root of the API, https://api.github.com by default.
+	APIURL string
+	Token  string
+	Client *http.Client
+}
+
+// SetStatus implements Reporter.
+func (g *GitHub) SetStatus(ctx context.Context, repo, commit string, status Status) error {
+	api := g.APIURL
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	url := fmt.Sprintf("%s/repos/%s/statuses/%s", strings.TrimSuffix(api, "/"), repo, commit)
+	return errors.Trace(post(ctx, g.Client, url, "Bearer "+g.Token, status))
+}
+
+// Gitea sets commit statuses through the Gitea REST API.
+type Gitea struct {
+	// URL is the root of the Gitea instance, e.g. https://gitea.example.com.
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// SetStatus implements Reporter.
+func (g *Gitea) SetStatus(ctx context.Context, repo, commit string, status Status) error {
+	if g.URL == "" {
+		return errors.NotValidf("Gitea reporter without a URL")
+	}
+	url := fmt.Sprintf("%s/api/v1/repos/%s/statuses/%s", strings.TrimSuffix(g.URL, "/"), repo, commit)
+	return errors.Trace(post(ctx, g.Client, url, "token "+g.Token, status))
+}
+
+// post sends a status to a forge's API.
+func post(ctx context.Context, client *http.Client, url, authorization string, status Status) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// Both forges limit descriptions to 140 characters
+	if description := []rune(status.Description); len(description) > 140 {
+		status.Description = string(description[:137]) + "..."
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", authorization)
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Annotatef(err, "unable to set status '%s'", status.Context)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("unable to set status '%s': %s: %s", status.Context, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// request is what a test forge received.
+type request struct {
+	method        string
+	path          string
+	authorization string
+	contentType   string
+	status        Status
+}
+
+// testForge starts a server recording the statuses it is sent, answering with code.
+func testForge(t *testing.T, code int) (*httptest.Server, *[]request) {
+	requests := []request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received := request{
+			method:        r.Method,
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			contentType:   r.Header.Get("Content-Type"),
+		}
+		if err := json.Unmarshal(body, &received.status); err != nil {
+			t.Errorf("status is not JSON: %s", err)
+		}
+		requests = append(requests, received)
+		w.WriteHeader(code)
+		w.Write([]byte(`{"message": "nope"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestGitHubSetStatus(t *testing.T) {
+	server, requests := testForge(t, http.StatusCreated)
+	g := &GitHub{APIURL: server.URL + "/", Token: "ghp_token"}
+	status := Status{Context: "nanoci/build", State: StateSuccess, Description: "Succeeded in 1s", TargetURL: "https://ci.example.com/runs/1"}
+	if err := g.SetStatus(context.Background(), "homelabtools/nanoci", "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c", status); err != nil {
+		t.Fatal(err)
+	}
+	want := request{
+		method:        http.MethodPost,
+		path:          "/repos/homelabtools/nanoci/statuses/b6589fc6ab0dc82cf12099d1c2d40ab994e8410c",
+		authorization: "Bearer ghp_token",
+		contentType:   "application/json",
+		status:        status,
+	}
+	if len(*requests) != 1 || (*requests)[0] != want {
+		t.Errorf("got %+v, want %+v", *requests, want)
+	}
+}
+
+func TestGiteaSetStatus(t *testing.T) {
+	server, requests := testForge(t, http.StatusCreated)
+	g := &Gitea{URL: server.URL, Token: "gitea_token"}
+	status := Status{Context: "nanoci", State: StatePending, Description: "Running"}
+	if err := g.SetStatus(context.Background(), "homelab/nanoci", "9f1e2d3c4b5a69788776655443322110ffeeddcc", status); err != nil {
+		t.Fatal(err)
+	}
+	want := request{
+		method:        http.MethodPost,
+		path:          "/api/v1/repos/homelab/nanoci/statuses/9f1e2d3c4b5a69788776655443322110ffeeddcc",
+		authorization: "token gitea_token",
+		contentType:   "application/json",
+		status:        status,
+	}
+	if len(*requests) != 1 || (*requests)[0] != want {
+		t.Errorf("got %+v, want %+v", *requests, want)
+	}
+}
+
+func TestGiteaWithoutURL(t *testing.T) {
+	g := &Gitea{Token: "gitea_token"}
+	if err := g.SetStatus(context.Background(), "homelab/nanoci", "9f1e2d3c4b5a69788776655443322110ffeeddcc", Status{}); err == nil {
+		t.Errorf("expected an error for a Gitea reporter without a URL")
+	}
+}
+
+func TestSetStatusTruncatesDescription(t *testing.T) {
+	server, requests := testForge(t, http.StatusCreated)
+	g := &GitHub{APIURL: server.URL, Token: "ghp_token"}
+	status := Status{Context: "nanoci", State: StateError, Description: "Unable to run: " + strings.Repeat("x", 200)}
+	if err := g.SetStatus(context.Background(), "homelabtools/nanoci", "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c", status); err != nil {
+		t.Fatal(err)
+	}
+	description := (*requests)[0].status.Description
+	if len(description) != 140 || !strings.HasSuffix(description, "...") {
+		t.Errorf("description was not truncated to 140 characters: %q", description)
+	}
+}
+
+func TestSetStatusTruncatesDescriptionByCharacter(t *testing.T) {
+	server, requests := testForge(t, http.StatusCreated)
+	g := &GitHub{APIURL: server.URL, Token: "ghp_token"}
+	status := Status{Context: "nanoci", State: StateFailure, Description: "Failed: " + strings.Repeat("é", 200)}
+	if err := g.SetStatus(context.Background(), "homelabtools/nanoci", "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c", status); err != nil {
+		t.Fatal(err)
+	}
+	description := (*requests)[0].status.Description
+	if !utf8.ValidString(description) || utf8.RuneCountInString(description) != 140 {
+		t.Errorf("description was not truncated to 140 characters: %q", description)
+	}
+}
+
+func TestSetStatusFailure(t *testing.T) {
+	server, _ := testForge(t, http.StatusUnprocessableEntity)
+	g := &GitHub{APIURL: server.URL, Token: "ghp_token"}
+	err := g.SetStatus(context.Background(), "homelabtools/nanoci", "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c", Status{Context: "nanoci/test", State: StateFailure})
+	if err == nil {
+		t.Fatal("expected an error for a 422 response")
+	}
+	for _, part := range []string{"nanoci/test", "422", "nope"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("error %q does not mention %q", err, part)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package forge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/homelabtools/nanoci/builder"
+)
+
+// How a pipeline is mapped onto commit statuses.
+const (
+	// ModePipeline reports one status for the whole pipeline.
+	ModePipeline = "pipeline"
+	// ModeStages reports one status for each top-level task of the pipeline, usually its stages.
+	// Hooks of the pipeline, such as those added with builder.Finally, get no status of their own.
+	ModeStages = "stages"
+)
+
+// Mapping turns pipelines into commit statuses.
+type Mapping struct {
+	// Mode is ModePipeline or ModeStages, ModePipeline by default.
+	Mode string
+	// Context names the status of the pipeline, and prefixes those of its stages, "nanoci" by default.
+	Context string
+	// TargetURL is linked to from every status, e.g. a page showing the run.
+	TargetURL string
+}
+
+func (m Mapping) context(stage string) string {
+	context := m.Context
+	if context == "" {
+		context = "nanoci"
+	}
+	if stage == "" {
+		return context
+	}
+	return context + "/" + stage
+}
+
+// Pending returns the statuses saying that a pipeline is about to run, given its plan.
+// In ModeStages, stages that would be skipped get no status.
+func (m Mapping) Pending(plan *builder.PlanStep) []Status {
+	if m.Mode != ModeStages {
+		return []Status{{Context: m.context(""), State: StatePending, Description: "Running", TargetURL: m.TargetURL}}
+	}
+	statuses := []Status{}
+	for _, stage := range plan.Children {
+		if stage.Skip || stage.Hook {
+			continue
+		}
+		statuses = append(statuses, Status{Context: m.context(stage.Name), State: StatePending, Description: "Waiting to run", TargetURL: m.TargetURL})
+	}
+	return statuses
+}
+
+// Finished returns the statuses describing the result of a pipeline.
+func (m Mapping) Finished(result *builder.Result) []Status {
+	if m.Mode != ModeStages {
+		return []Status{m.status("", result)}
+	}
+	statuses := []Status{}
+	for _, stage := range result.Children {
+		if stage.Hook {
+			continue
+		}
+		statuses = append(statuses, m.status(stage.Name, stage))
+	}
+	return statuses
+}
+
+// Failed returns the statuses saying that a pipeline could not be run, given the plan it had, if any.
+func (m Mapping) Failed(plan *builder.PlanStep, err error) []Status {
+	description := "Unable to run: " + err.Error()
+	if m.Mode != ModeStages || plan == nil {
+		return []Status{{Context: m.context(""), State: StateError, Description: description, TargetURL: m.TargetURL}}
+	}
+	statuses := []Status{}
+	for _, stage := range plan.Children {
+		if !stage.Skip && !stage.Hook {
+			statuses = append(statuses, Status{Context: m.context(stage.Name), State: StateError, Description: description, TargetURL: m.TargetURL})
+		}
+	}
+	return statuses
+}
+
+// status maps the result of a task onto a commit status. Skipped tasks and allowed failures
+// do not fail the commit.
+func (m Mapping) status(stage string, r *builder.Result) Status {
+	s := Status{Context: m.context(stage), TargetURL: m.TargetURL}
+	duration := r.Duration.Round(time.Millisecond)
+	switch r.Status {
+	case builder.StatusSuccess:
+		s.State, s.Description = StateSuccess, fmt.Sprintf("Succeeded in %s", duration)
+	case builder.StatusAllowedFailure:
+		s.State, s.Description = StateSuccess, fmt.Sprintf("Failed, which is allowed, in %s", duration)
+	case builder.StatusSkipped:
+		s.State, s.Description = StateSuccess, "Skipped: "+r.SkipReason
+	case builder.StatusFailed:
+		s.State, s.Description = StateFailure, fmt.Sprintf("Failed after %s", duration)
+		if failed := firstFailure(r); failed != nil && failed != r {
+			s.Description = fmt.Sprintf("%s failed after %s", strings.TrimPrefix(failed.Path, "root/"), duration)
+		}
+	default:
+		s.State, s.Description = StatePending, "Running"
+	}
+	return s
+}
+
+// firstFailure returns the deepest failed task along the first path of failures below r.
+func firstFailure(r *builder.Result) *builder.Result {
+	for _, child := range r.Children {
+		if child.Status == builder.StatusFailed {
+			return firstFailure(child)
+		}
+	}
+	if r.Status == builder.StatusFailed {
+		return r
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package forge
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/homelabtools/nanoci/builder"
+)
+
+func TestMappingPipeline(t *testing.T) {
+	m := Mapping{Context: "ci", TargetURL: "https://ci.example.com/runs/1"}
+	plan := &builder.PlanStep{Name: "root", Children: []*builder.PlanStep{{Name: "build"}}}
+	if got, want := m.Pending(plan), []Status{{Context: "ci", State: StatePending, Description: "Running", TargetURL: m.TargetURL}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pending: got %+v, want %+v", got, want)
+	}
+	result := &builder.Result{Name: "root", Path: "root", Status: builder.StatusSuccess, Duration: 1500 * time.Millisecond}
+	if got, want := m.Finished(result), []Status{{Context: "ci", State: StateSuccess, Description: "Succeeded in 1.5s", TargetURL: m.TargetURL}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("finished: got %+v, want %+v", got, want)
+	}
+	if got, want := m.Failed(plan, errors.New("no builder")), []Status{{Context: "ci", State: StateError, Description: "Unable to run: no builder", TargetURL: m.TargetURL}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("failed: got %+v, want %+v", got, want)
+	}
+}
+
+func TestMappingStages(t *testing.T) {
+	m := Mapping{Mode: ModeStages}
+	plan := &builder.PlanStep{Name: "root", Children: []*builder.PlanStep{
+		{Name: "build"},
+		{Name: "deploy", Skip: true},
+		{Name: "test"},
+		{Name: "cleanup", Hook: true},
+	}}
+	pending := []Status{
+		{Context: "nanoci/build", State: StatePending, Description: "Waiting to run"},
+		{Context: "nanoci/test", State: StatePending, Description: "Waiting to run"},
+	}
+	if got := m.Pending(plan); !reflect.DeepEqual(got, pending) {
+		t.Errorf("pending: got %+v, want %+v", got, pending)
+	}
+	failed := []Status{
+		{Context: "nanoci/build", State: StateError, Description: "Unable to run: no builder"},
+		{Context: "nanoci/test", State: StateError, Description: "Unable to run: no builder"},
+	}
+	if got := m.Failed(plan, errors.New("no builder")); !reflect.DeepEqual(got, failed) {
+		t.Errorf("failed: got %+v, want %+v", got, failed)
+	}
+
+	result := &builder.Result{Name: "root", Path: "root", Status: builder.StatusFailed, Children: []*builder.Result{
+		{Name: "build", Path: "root/build", Status: builder.StatusSuccess, Duration: time.Second},
+		{Name: "lint", Path: "root/lint", Status: builder.StatusAllowedFailure, Duration: 2 * time.Second},
+		{Name: "test", Path: "root/test", Status: builder.StatusFailed, Duration: 3 * time.Second, Children: []*builder.Result{
+			{Name: "unit", Path: "root/test/unit", Status: builder.StatusSuccess},
+			{Name: "e2e", Path: "root/test/e2e", Status: builder.StatusFailed},
+		}},
+		{Name: "deploy", Path: "root/deploy", Status: builder.StatusSkipped, SkipReason: "not on main"},
+		{Name: "cleanup", Path: "root/cleanup", Status: builder.StatusSuccess, Hook: true},
+		{Name: "alert", Path: "root/alert", Status: builder.StatusFailed, Hook: true},
+	}}
+	finished := []Status{
+		{Context: "nanoci/build", State: StateSuccess, Description: "Succeeded in 1s"},
+		{Context: "nanoci/lint", State: StateSuccess, Description: "Failed, which is allowed, in 2s"},
+		{Context: "nanoci/test", State: StateFailure, Description: "test/e2e failed after 3s"},
+		{Context: "nanoci/deploy", State: StateSuccess, Description: "Skipped: not on main"},
+	}
+	if got := m.Finished(result); !reflect.DeepEqual(got, finished) {
+		t.Errorf("finished: got\n%+v\nwant\n%+v", got, finished)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/homelabtools/nanoci/builder"
+	"github.com/juju/errors"
+)
+
+// historyCommand implements `nanoci history`.
+func historyCommand(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	stateDir := flags.String("state-dir", "", "directory runs are recorded in (default $NANOCI_STATE_DIR or .nanoci)")
+	flags.Parse(args)
+	if *stateDir != "" {
+		builder.StateDir(*stateDir)
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		return listRuns()
+	case "show":
+		if len(args) != 2 {
+			return errors.New("usage: nanoci history show <run>")
+		}
+		return showRun(args[1])
+	case "log":
+		if len(args) != 3 {
+			return errors.New("usage: nanoci history log <run> <task>")
+		}
+		return showTaskLog(args[1], args[2])
+	case "graph":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: nanoci history graph <run> [dot|mermaid]")
+		}
+		format := "dot"
+		if len(args) == 3 {
+			format = args[2]
+		}
+		return showRunGraph(args[1], format)
+	default:
+		return errors.Errorf("unknown history command '%s'", args[0])
+	}
+}
+
+func listRuns() error {
+	records, err := builder.ListRuns()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tPIPELINE\tSTATUS\tSTARTED\tDURATION\tBRANCH\tCOMMIT")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Pipeline, r.Status, r.Start.Local().Format(time.RFC3339),
+			r.Duration.Round(time.Millisecond), r.Git.Branch, shortCommit(r.Git))
+	}
+	return errors.Trace(tw.Flush())
+}
+
+func showRun(runID string) error {
+	record, err := resolveRun(runID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("Run:      %s\n", record.ID)
+	fmt.Printf("Pipeline: %s\n", record.Pipeline)
+	fmt.Printf("Status:   %s\n", record.Status)
+	fmt.Printf("Started:  %s\n", record.Start.Local().Format(time.RFC3339))
+	fmt.Printf("Duration: %s\n", record.Duration.Round(time.Millisecond))
+	if record.Git.Commit != "" {
+		fmt.Printf("Commit:   %s %s\n", shortCommit(record.Git), record.Git.Subject)
+		fmt.Printf("Branch:   %s\n", record.Git.Branch)
+	}
+	fmt.Println()
+	return errors.Trace(record.Result.PrintSummary(os.Stdout))
+}
+
+func showTaskLog(runID, taskPath string) error {
+	record, err := resolveRun(runID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	output, err := builder.TaskLog(record.ID, taskPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Print(output)
+	return nil
+}
+
+func showRunGraph(runID, format string) error {
+	record, err := resolveRun(runID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	switch format {
+	case "dot":
+		return errors.Trace(record.Result.WriteDOT(os.Stdout, true))
+	case "mermaid":
+		return errors.Trace(record.Result.WriteMermaid(os.Stdout, true))
+	default:
+		return errors.Errorf("unknown graph format '%s', must be 'dot' or 'mermaid'", format)
+	}
+}
+
+// resolveRun loads a run by its ID, where "latest" means the most recent run.
+func resolveRun(runID string) (*builder.RunRecord, error) {
+	if runID != "latest" {
+		return builder.LoadRun(runID)
+	}
+	records, err := builder.ListRuns()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(records) == 0 {
+		return nil, errors.NotFoundf("any runs")
+	}
+	return records[0], nil
+}
+
+func shortCommit(git builder.GitInfo) string {
+	commit := git.Commit
+	if len(commit) > 8 {
+		commit = commit[:8]
+	}
+	if git.Dirty {
+		commit += "+"
+	}
+	return commit
+}
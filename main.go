@@ -2,55 +2,53 @@ package main
 
 import (
 	"fmt"
+	"os"
 
-	"github.com/homelabtools/nanoci/builder"
-	. "github.com/homelabtools/nanoci/builder"
+	"github.com/juju/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
-func main() {
-	builder.BuilderMain()
-	Step("", func() {})
-	//Begin(Stage("my build",
-	//	Step(func() error {
-	//		_, _, err := SH("echo task 1; sleep 2; echo task1a; sleep 1; echo task1b")
-	//		return err
-	//	}),
-	//	Step("echo 2", func() error {
-	//		_, _, err := SH("echao task 2")
-	//		return err
-	//	}).NoFailOnError(), //),
-	//	Step("task 3", func() error {
-	//		_, e, err := SH("echo nofail 1>&2")
-	//		fmt.Println(e)
-	//		return err
-	//	}),
-	//))
-	//Context(func(m map[string]interface{}) {
-	//	fmt.Println("🤘")
-	//})
-	//Context(foo)
-	//Context(A.B)
-}
-
-func foo(args map[string]interface{}) {
-	fmt.Println("🤘")
-}
-
-type A struct {
+const usage = `Usage: nanoci <command> [arguments]
+
+Commands:
+  history list                 List past runs
+  history show <run>           Show the summary of a run
+  history log <run> <task>     Print the log of a task in a run
+  history graph <run> [format] Print a run as a coloured 'dot' or 'mermaid' diagram
+  secrets keygen               Generate a key for the secrets file
+  secrets set <name> [value]   Store a secret, reading the value from stdin if it is not given
+  secrets get <name>           Print a secret
+  secrets list                 List the names of all secrets
+  secrets rm <name>            Remove a secret
+  serve [options]              Build pushes and pull requests reported by Gitea or GitHub webhooks
+`
+
+func init() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
-func (A) B() {
-	fmt.Println("B")
-}
-
-// Context executes a function elsewhere
-func Context(fn interface{}) {
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "history":
+		err = historyCommand(os.Args[2:])
+	case "secrets":
+		err = secretsCommand(os.Args[2:])
+	case "serve":
+		err = serveCommand(os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Error().Msg(errors.ErrorStack(err))
+		os.Exit(1)
+	}
 }
-
-//// Context executes a function elsewhere
-//func Context(fn interface{}) {
-//	err := codegen.ProgramizeFunction(1, "gen")
-//	if err != nil {
-//		panic(err)
-//	}
-//}
@@ -0,0 +1,56 @@
+// Package proc runs external processes that can be cancelled with a context.Context.
+package proc
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/juju/errors"
+)
+
+// Process is a running command whose whole process tree is killed when its context is done.
+type Process struct {
+	cmd  *exec.Cmd
+	ctx  context.Context
+	done chan struct{}
+}
+
+// Start starts cmd in its own process group. If ctx is done before the process exits, the process
+// and every child it started are killed. This differs from exec.CommandContext, which only kills
+// the direct child and leaves e.g. the commands run by `sh -c` behind.
+func Start(ctx context.Context, cmd *exec.Cmd) (*Process, error) {
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p := &Process{cmd: cmd, ctx: ctx, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-p.done:
+		}
+	}()
+	return p, nil
+}
+
+// Wait waits for the process to exit. If the process was killed because its context was done,
+// the returned error says so.
+func (p *Process) Wait() error {
+	err := p.cmd.Wait()
+	close(p.done)
+	if err != nil && p.ctx.Err() != nil {
+		return errors.Annotatef(p.ctx.Err(), "process '%s' was killed", p.cmd.Path)
+	}
+	return err
+}
+
+// Run starts cmd like Start and waits for it to exit.
+func Run(ctx context.Context, cmd *exec.Cmd) error {
+	p, err := Start(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return p.Wait()
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package proc
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	// A negative PID signals every process in the group
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+// +build !windows
+
+package proc
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// exited reports whether the process has exited, counting processes that were not reaped yet.
+func exited(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestKillProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := exec.Command("sh", "-c", "sleep 30 & echo $! > "+pidFile+"; wait")
+	p, err := Start(ctx, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := 0
+	for deadline := time.Now().Add(5 * time.Second); pid == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if pid == 0 {
+		t.Fatal("the shell did not start its child")
+	}
+	cancel()
+	err = p.Wait()
+	if err == nil || !strings.Contains(err.Error(), "was killed: context canceled") {
+		t.Errorf("got error %v, want the process reported as killed", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); !exited(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatal("the child of the killed process is still running")
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	if err := Run(context.Background(), exec.Command("true")); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	err := Run(context.Background(), exec.Command("false"))
+	if err == nil || strings.Contains(err.Error(), "killed") {
+		t.Errorf("got error %v, want the exit status", err)
+	}
+}
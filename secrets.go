@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/homelabtools/nanoci/secrets"
+	"github.com/juju/errors"
+)
+
+// secretsCommand implements `nanoci secrets`.
+func secretsCommand(args []string) error {
+	flags := flag.NewFlagSet("secrets", flag.ExitOnError)
+	file := flags.String("file", "", "encrypted secrets file (default $"+secrets.FileEnvVar+" or secrets.enc in the user config directory)")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New("usage: nanoci secrets keygen|set|get|list|rm")
+	}
+	if args[0] == "keygen" {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Println(key)
+		return nil
+	}
+	path := *file
+	if path == "" {
+		var err error
+		path, err = secrets.DefaultPath()
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	key, err := secrets.LoadKey()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store, err := secrets.Open(path, key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	switch args[0] {
+	case "set":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: nanoci secrets set <name> [value], the value is read from stdin if it is not given")
+		}
+		value := ""
+		if len(args) == 3 {
+			value = args[2]
+		} else {
+			value, err = readSecretValue()
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		store.Set(args[1], value)
+		return errors.Trace(store.Save())
+	case "get":
+		if len(args) != 2 {
+			return errors.New("usage: nanoci secrets get <name>")
+		}
+		value, ok := store.Get(args[1])
+		if !ok {
+			return errors.NotFoundf("secret '%s'", args[1])
+		}
+		fmt.Println(value)
+		return nil
+	case "list":
+		for _, name := range store.Names() {
+			fmt.Println(name)
+		}
+		return nil
+	case "rm":
+		if len(args) != 2 {
+			return errors.New("usage: nanoci secrets rm <name>")
+		}
+		if !store.Delete(args[1]) {
+			return errors.NotFoundf("secret '%s'", args[1])
+		}
+		return errors.Trace(store.Save())
+	default:
+		return errors.Errorf("unknown secrets command '%s'", args[0])
+	}
+}
+
+// readSecretValue reads a secret from stdin, all of it if it is piped in, or one line if it is typed.
+func readSecretValue() (string, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	reader := bufio.NewReader(os.Stdin)
+	if stat.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Value: ")
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	data := strings.Builder{}
+	_, err = reader.WriteTo(&data)
+	return strings.TrimRight(data.String(), "\r\n"), errors.Trace(err)
+}
@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask is what secret values are replaced with.
+const Mask = "***"
+
+// Masker replaces known secret values in text with Mask.
+type Masker struct {
+	mu       sync.RWMutex
+	known    map[string]bool
+	values   []string
+	replacer *strings.Replacer
+}
+
+// Add registers values to be masked. Each line of a multi-line value is masked on its own,
+// since output is masked line by line. Values that are already masked are ignored, so Add can
+// be called for the same secret every time it is used.
+func (m *Masker) Add(values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	added := false
+	for _, value := range values {
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || m.known[line] {
+				continue
+			}
+			if m.known == nil {
+				m.known = map[string]bool{}
+			}
+			m.known[line] = true
+			m.values = append(m.values, line)
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	// Longer values go first so that a secret containing another one is masked completely
+	sort.Slice(m.values, func(i, j int) bool {
+		return len(m.values[i]) > len(m.values[j])
+	})
+	pairs := []string{}
+	for _, value := range m.values {
+		pairs = append(pairs, value, Mask)
+	}
+	m.replacer = strings.NewReplacer(pairs...)
+}
+
+// String returns s with every secret value replaced.
+func (m *Masker) String(s string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.replacer == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
+
+// Writer returns a writer that masks everything written to it before passing it on to w.
+// Each write is masked on its own, so it is only suitable for writers that receive whole
+// messages, such as a logger's output. Use LineWriter for streams.
+func (m *Masker) Writer(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		_, err := io.WriteString(w, m.String(string(p)))
+		return len(p), err
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// LineWriter masks a stream of output line by line, so that a secret split across two writes
+// is still masked. Call Flush once the stream has ended to write out a final incomplete line.
+type LineWriter struct {
+	masker *Masker
+	w      io.Writer
+	mu     sync.Mutex
+	buf    []byte
+}
+
+// maxLineLength is how much of a line is buffered before it is masked and written out anyway.
+const maxLineLength = 64 * 1024
+
+// LineWriter returns a LineWriter passing masked output on to w.
+func (m *Masker) LineWriter(w io.Writer) *LineWriter {
+	return &LineWriter{masker: m, w: w}
+}
+
+func (lw *LineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.buf = append(lw.buf, p...)
+	i := bytes.LastIndexByte(lw.buf, '\n')
+	if i < 0 && len(lw.buf) < maxLineLength {
+		return len(p), nil
+	}
+	if i < 0 {
+		i = len(lw.buf) - 1
+	}
+	_, err := io.WriteString(lw.w, lw.masker.String(string(lw.buf[:i+1])))
+	lw.buf = append(lw.buf[:0], lw.buf[i+1:]...)
+	return len(p), err
+}
+
+// Flush writes out any buffered incomplete line.
+func (lw *LineWriter) Flush() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(lw.w, lw.masker.String(string(lw.buf)))
+	lw.buf = lw.buf[:0]
+	return err
+}
@@ -0,0 +1,85 @@
+package secrets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMaskerString(t *testing.T) {
+	m := &Masker{}
+	if got := m.String("nothing to hide"); got != "nothing to hide" {
+		t.Errorf("got %q", got)
+	}
+	m.Add("hunter2", "token-hunter2-long", "  -----BEGIN KEY-----\nAAAA\n\n-----END KEY-----\n", "")
+	tests := map[string]string{
+		"password is hunter2":                          "password is ***",
+		"hunter2hunter2":                               "******",
+		"token is token-hunter2-long":                  "token is ***",
+		"-----BEGIN KEY-----\nAAAA\n-----END KEY-----": "***\n***\n***",
+		"nothing to hide":                              "nothing to hide",
+	}
+	for in, want := range tests {
+		if got := m.String(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	m := &Masker{}
+	m.Add("hunter2")
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"whole lines", []string{"password hunter2\n", "again hunter2\n"}, "password ***\nagain ***\n"},
+		{"secret split across writes", []string{"password hun", "ter2\n"}, "password ***\n"},
+		{"secret split byte by byte", []string{"h", "u", "n", "t", "e", "r", "2", "\n"}, "***\n"},
+		{"several lines in one write", []string{"a hunter2\nb hunter2\nc hun", "ter2"}, "a ***\nb ***\nc ***"},
+		{"final line without newline", []string{"hunter2"}, "***"},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		lw := m.LineWriter(out)
+		for _, write := range test.writes {
+			n, err := lw.Write([]byte(write))
+			if err != nil || n != len(write) {
+				t.Fatalf("%s: write returned %d, %v", test.name, n, err)
+			}
+		}
+		if err := lw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, out, test.want)
+		}
+	}
+}
+
+func TestLineWriterLongLine(t *testing.T) {
+	m := &Masker{}
+	m.Add("hunter2")
+	out := &bytes.Buffer{}
+	lw := m.LineWriter(out)
+	lw.Write(bytes.Repeat([]byte("x"), maxLineLength))
+	if out.Len() != maxLineLength {
+		t.Errorf("a line of %d bytes was not written out, %d bytes were", maxLineLength, out.Len())
+	}
+}
+
+func TestMaskerAddSameValue(t *testing.T) {
+	m := &Masker{}
+	m.Add("hunter2")
+	replacer := m.replacer
+	for i := 0; i < 100; i++ {
+		m.Add("hunter2", "hunter2\n")
+	}
+	if len(m.values) != 1 || m.replacer != replacer {
+		t.Errorf("adding a known value again grew the masker to %d values or rebuilt it", len(m.values))
+	}
+	m.Add("hunter3")
+	if len(m.values) != 2 || m.String("hunter2 hunter3") != "*** ***" {
+		t.Errorf("a new value was not added")
+	}
+}
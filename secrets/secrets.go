@@ -0,0 +1,217 @@
+// Package secrets keeps named secrets in a file encrypted with AES-256-GCM.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// KeyEnvVar holds the key as 64 hex characters.
+	KeyEnvVar = "NANOCI_SECRETS_KEY"
+	// KeyFileEnvVar names a file holding the key, used when KeyEnvVar is not set.
+	KeyFileEnvVar = "NANOCI_SECRETS_KEY_FILE"
+	// FileEnvVar names the encrypted secrets file.
+	FileEnvVar = "NANOCI_SECRETS_FILE"
+)
+
+const keySize = 32
+
+// fileFormat is what is written to the secrets file. Data is the encrypted JSON of the secrets.
+type fileFormat struct {
+	Version int    `json:"version"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Store is a set of named secrets backed by an encrypted file.
+type Store struct {
+	path   string
+	key    []byte
+	values map[string]string
+}
+
+// GenerateKey returns a new random key, hex encoded, suitable for KeyEnvVar or a key file.
+func GenerateKey() (string, error) {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to generate key")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// ParseKey decodes a hex encoded key.
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != keySize {
+		return nil, errors.Errorf("secrets key must be %d hex characters, generate one with `nanoci secrets keygen`", keySize*2)
+	}
+	return key, nil
+}
+
+// LoadKey reads the key from KeyEnvVar, or else from the file named by KeyFileEnvVar,
+// or else from secrets.key in the user's nanoci config directory.
+func LoadKey() ([]byte, error) {
+	if encoded := os.Getenv(KeyEnvVar); encoded != "" {
+		return ParseKey(encoded)
+	}
+	keyFile := os.Getenv(KeyFileEnvVar)
+	if keyFile == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		keyFile = filepath.Join(dir, "secrets.key")
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return nil, errors.NotFoundf("secrets key, set $%s or create '%s'", KeyEnvVar, keyFile)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read secrets key file '%s'", keyFile)
+	}
+	return ParseKey(string(data))
+}
+
+// DefaultPath returns the secrets file named by FileEnvVar, or else secrets.enc in the
+// user's nanoci config directory.
+func DefaultPath() (string, error) {
+	if path := os.Getenv(FileEnvVar); path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "secrets.enc"), nil
+}
+
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Annotatef(err, "unable to find the user's config directory")
+	}
+	return filepath.Join(dir, "nanoci"), nil
+}
+
+// OpenDefault opens the default secrets file with the default key.
+func OpenDefault() (*Store, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadKey()
+	if err != nil {
+		return nil, err
+	}
+	return Open(path, key)
+}
+
+// Open decrypts the secrets file at path. A file that does not exist yet is an empty store.
+func Open(path string, key []byte) (*Store, error) {
+	s := &Store{path: path, key: key, values: map[string]string{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read secrets file '%s'", path)
+	}
+	file := &fileFormat{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, errors.Annotatef(err, "secrets file '%s' is corrupt", path)
+	}
+	if file.Version != 1 {
+		return nil, errors.Errorf("secrets file '%s' has unsupported version %d", path, file.Version)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, errors.Errorf("unable to decrypt secrets file '%s', the key is wrong or the file was modified", path)
+	}
+	if err := json.Unmarshal(plaintext, &s.values); err != nil {
+		return nil, errors.Annotatef(err, "secrets file '%s' is corrupt", path)
+	}
+	return s, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	return gcm, errors.Trace(err)
+}
+
+// Save encrypts the secrets with a fresh nonce and writes them to the store's file,
+// readable only by the current user.
+func (s *Store) Save() error {
+	plaintext, err := json.Marshal(s.values)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Annotatef(err, "failed to generate nonce")
+	}
+	data, err := json.Marshal(&fileFormat{Version: 1, Nonce: nonce, Data: gcm.Seal(nil, nonce, plaintext, nil)})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return errors.Annotatef(err, "failed to create directory for secrets file")
+	}
+	// Write to a temporary file and rename it, so that a failed write never loses the existing secrets
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Annotatef(err, "failed to write secrets file '%s'", s.path)
+	}
+	return errors.Annotatef(os.Rename(tmp, s.path), "failed to write secrets file '%s'", s.path)
+}
+
+// Get returns the secret with the given name.
+func (s *Store) Get(name string) (string, bool) {
+	value, ok := s.values[name]
+	return value, ok
+}
+
+// Set adds or replaces a secret. Call Save to write the change to disk.
+func (s *Store) Set(name, value string) {
+	s.values[name] = value
+}
+
+// Delete removes a secret. Call Save to write the change to disk.
+func (s *Store) Delete(name string) bool {
+	_, ok := s.values[name]
+	delete(s.values, name)
+	return ok
+}
+
+// Names returns the names of all secrets, sorted.
+func (s *Store) Names() []string {
+	names := []string{}
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/homelabtools/nanoci/forge"
+	"github.com/homelabtools/nanoci/webhook"
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// patternList is a flag that can be given several times.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// serveCommand implements `nanoci serve`.
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	config := webhook.Config{}
+	listen := flags.String("listen", ":8080", "address to accept webhooks on, at the path /webhook")
+	flags.StringVar(&config.Secret, "secret", os.Getenv("NANOCI_WEBHOOK_SECRET"), "secret webhook payloads are signed with (default $NANOCI_WEBHOOK_SECRET)")
+	flags.BoolVar(&config.Insecure, "insecure-no-signature", false, "accept unsigned webhooks when no secret is set, letting anyone who can reach the server run code on it")
+	flags.Var((*patternList)(&config.Branches), "branch", "only build pushes to, and pull requests into, branches matching this pattern (repeatable)")
+	flags.Var((*patternList)(&config.Tags), "tag", "only build tags matching this pattern (repeatable)")
+	flags.Var((*patternList)(&config.Paths), "path", "only build changes to files matching this pattern, e.g. 'services/api/**' (repeatable)")
+	flags.StringVar(&config.BuilderDir, "builder-dir", "ci", "directory of the builder module within the repository")
+	flags.StringVar(&config.WorkspaceDir, "workspace-dir", "", "directory workspaces are checked out in (default workspaces in the state directory)")
+	flags.StringVar(&config.StateDir, "state-dir", "", "directory runs are recorded in (default $NANOCI_STATE_DIR or .nanoci)")
+	flags.StringVar(&config.CloneURL, "clone-url", "", "clone this instead of the repository named in the payload, e.g. a local mirror")
+	flags.Var((*patternList)(&config.PassEnv), "pass-env", "pass this environment variable to builders, which only get PATH, HOME and the like by default (repeatable)")
+	flags.BoolVar(&config.KeepWorkspaces, "keep-workspaces", false, "keep workspaces after their builds")
+	flags.IntVar(&config.Concurrency, "concurrency", 1, "how many builds may run at once")
+	githubToken := flags.String("github-token", os.Getenv("NANOCI_GITHUB_TOKEN"), "token to set commit statuses on GitHub with (default $NANOCI_GITHUB_TOKEN)")
+	githubAPI := flags.String("github-api", "", "root of the GitHub API, e.g. that of a GitHub Enterprise server (default https://api.github.com)")
+	giteaToken := flags.String("gitea-token", os.Getenv("NANOCI_GITEA_TOKEN"), "token to set commit statuses on Gitea with (default $NANOCI_GITEA_TOKEN)")
+	giteaURL := flags.String("gitea-url", "", "root of the Gitea server, required with --gitea-token")
+	flags.StringVar(&config.Statuses.Mode, "status-mode", forge.ModePipeline, "report one commit status per 'pipeline', or one per top-level task with 'stages'")
+	flags.StringVar(&config.Statuses.Context, "status-context", "nanoci", "name of the commit status, and prefix of those of stages")
+	externalURL := flags.String("external-url", "", "URL the server is reachable at, which commit statuses link to (default http://<listen address>)")
+	flags.Usage = func() {
+		flags.Output().Write([]byte("Usage: nanoci serve [options] [-- builder arguments]\n"))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	config.BuilderArgs = flags.Args()
+	if config.Statuses.Mode != forge.ModePipeline && config.Statuses.Mode != forge.ModeStages {
+		return errors.NotValidf("status mode '%s'", config.Statuses.Mode)
+	}
+	config.Reporters = map[string]forge.Reporter{}
+	if *githubToken != "" {
+		config.Reporters[webhook.ForgeGitHub] = &forge.GitHub{APIURL: *githubAPI, Token: *githubToken}
+	}
+	if *giteaToken != "" {
+		if *giteaURL == "" {
+			return errors.New("--gitea-url must be set along with a Gitea token")
+		}
+		config.Reporters[webhook.ForgeGitea] = &forge.Gitea{URL: *giteaURL, Token: *giteaToken}
+	}
+	if *externalURL == "" {
+		*externalURL = "http://" + *listen
+		if strings.HasPrefix(*listen, ":") {
+			*externalURL = "http://localhost" + *listen
+		}
+	}
+	config.RunURL = strings.TrimSuffix(*externalURL, "/") + "/runs/"
+	if config.Secret == "" {
+		if !config.Insecure {
+			return errors.New("no webhook secret is set, set --secret or $NANOCI_WEBHOOK_SECRET, or pass --insecure-no-signature")
+		}
+		log.Warn().Msg("No webhook secret is set, anyone who can reach the server can run code on it")
+	}
+	server, err := webhook.NewServer(config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", server)
+	mux.Handle("/runs/", webhook.RunsHandler())
+	httpServer := &http.Server{Addr: *listen, Handler: mux}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Info().Msgf("Received %s, waiting for running builds to finish", sig)
+		httpServer.Shutdown(context.Background())
+	}()
+	log.Info().Msgf("Accepting webhooks on %s/webhook, serving runs at %s", *listen, config.RunURL)
+	err = httpServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return errors.Trace(err)
+	}
+	server.Close(context.Background())
+	return nil
+}
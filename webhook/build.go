@@ -0,0 +1,214 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/homelabtools/nanoci/builder"
+	"github.com/homelabtools/nanoci/codegen"
+	"github.com/homelabtools/nanoci/proc"
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Build is the build of one event.
+type Build struct {
+	// ID is also the ID of the builder's run, see builder.LoadRun.
+	ID        string
+	Event     *Event
+	Workspace string
+	// Skipped says why the event was not built after all, e.g. because no changed file matched.
+	Skipped string
+	Status  builder.Status
+	// Run is the record of the builder's run, nil if the builder did not get to record it.
+	Run *builder.RunRecord
+}
+
+// Build checks out the event's commit into a fresh workspace, then compiles and runs the builder
+// module found there. A build whose pipeline fails is not an error, see Build.Status; failing to
+// check out, compile or start the builder is.
+func (s *Server) Build(ctx context.Context, e *Event) (*Build, error) {
+	b := &Build{ID: builder.NewRunID(), Event: e, Status: builder.StatusFailed}
+	workspace, err := filepath.Abs(filepath.Join(s.workspaceDir(), b.ID))
+	if err != nil {
+		return b, errors.Trace(err)
+	}
+	b.Workspace = workspace
+	if !s.config.KeepWorkspaces {
+		defer os.RemoveAll(workspace)
+	}
+	status := s.statusReporter(b)
+	log.Info().Msgf("Checking out %s into %s", e, workspace)
+	if err := s.checkout(ctx, e, workspace); err != nil {
+		// git's output can include the clone URL and its credentials, only the log gets the details
+		status.failed(ctx, nil, errors.New("the commit could not be checked out"))
+		return b, errors.Annotatef(err, "unable to check out %s", e)
+	}
+	if len(s.config.Paths) > 0 && e.ChangedFiles == nil {
+		files, err := s.changedFiles(ctx, e, workspace)
+		if err != nil {
+			log.Warn().Msgf("Unable to find the files changed by %s, building it anyway: %s", e, err)
+		} else if !s.matchesPaths(files) {
+			b.Skipped = "no changed file matches " + strings.Join(s.config.Paths, ", ")
+			b.Status = builder.StatusSkipped
+			return b, nil
+		}
+	}
+	// The builder is compiled outside of the workspace, so that it does not show up as a change to it
+	binary := workspace + ".builder"
+	defer os.Remove(binary)
+	program, err := codegen.BuildModule(filepath.Join(workspace, s.config.BuilderDir), binary)
+	if err != nil {
+		status.failed(ctx, nil, errors.New("the builder does not compile"))
+		return b, errors.Annotatef(err, "unable to compile the builder of %s", e)
+	}
+	program.Args = s.config.BuilderArgs
+	program.WorkDir = workspace
+	program.Env = append(s.inheritedEnv(), s.buildEnv(b)...)
+	var pipelinePlan *builder.PlanStep
+	if status.needsPlan() {
+		if pipelinePlan, err = plan(ctx, program); err != nil {
+			status.failed(ctx, nil, err)
+			return b, errors.Trace(err)
+		}
+	}
+	status.pending(ctx, pipelinePlan)
+	log.Info().Msgf("Running build %s of %s", b.ID, e)
+	runErr := program.RunContext(ctx, nil)
+	b.Run, err = builder.LoadRun(b.ID)
+	if err != nil {
+		if runErr != nil {
+			err = errors.Annotatef(runErr, "builder of %s failed before recording its run", e)
+		} else {
+			err = errors.Annotatef(err, "builder of %s did not record its run", e)
+		}
+		status.failed(ctx, pipelinePlan, errors.New("the builder did not record its run"))
+		return b, err
+	}
+	b.Status = b.Run.Status
+	status.finished(ctx, b.Run.Result)
+	return b, nil
+}
+
+// inheritedEnv are the variables of the server's environment that builders get. The builder of a
+// pull request runs code from whoever opened it, so the server's own credentials, such as the
+// webhook secret, forge tokens and secrets key, must never be passed through.
+var inheritedEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TMPDIR", "TERM", "LANG", "LC_ALL", "TZ",
+	"GOPATH", "GOROOT", "GOCACHE", "GOMODCACHE", "GOPROXY", "GOPRIVATE", "GONOSUMDB", "GOFLAGS",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"SSL_CERT_FILE", "SSL_CERT_DIR", "DOCKER_HOST",
+}
+
+// inheritedEnv returns the variables of the server's environment that are passed to builders,
+// those in inheritedEnv and Config.PassEnv.
+func (s *Server) inheritedEnv() []string {
+	env := []string{}
+	for _, names := range [][]string{inheritedEnv, s.config.PassEnv} {
+		for _, name := range names {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+	return env
+}
+
+// buildEnv returns the environment variables telling the builder what it is building.
+func (s *Server) buildEnv(b *Build) []string {
+	e := b.Event
+	env := []string{
+		"NANOCI_RUN_ID=" + b.ID,
+		"NANOCI_STATE_DIR=" + s.stateDir(),
+		"NANOCI_PIPELINE=" + path.Base(e.Repo),
+		"NANOCI_EVENT=" + e.Kind,
+		"NANOCI_REPO=" + e.Repo,
+		"NANOCI_COMMIT=" + e.Commit,
+	}
+	if s.config.RunURL != "" {
+		env = append(env, "NANOCI_RUN_URL="+s.config.RunURL+b.ID)
+	}
+	if e.Branch != "" {
+		env = append(env, "NANOCI_BRANCH="+e.Branch)
+	}
+	if e.Tag != "" {
+		env = append(env, "NANOCI_TAG="+e.Tag)
+	}
+	if e.Kind == EventPullRequest {
+		env = append(env, "NANOCI_PR="+strconv.Itoa(e.Number), "NANOCI_BASE_BRANCH="+e.BaseBranch)
+	}
+	return env
+}
+
+// checkout clones the event's repository into dir and checks out the commit to build.
+func (s *Server) checkout(ctx context.Context, e *Event, dir string) error {
+	url := e.CloneURL
+	if s.config.CloneURL != "" {
+		url = s.config.CloneURL
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := git(ctx, "", "clone", "--quiet", "--no-checkout", "--", url, dir); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := git(ctx, dir, "cat-file", "-e", e.Commit+"^{commit}"); err != nil {
+		// The commit is no longer on a branch, e.g. because it was force pushed over
+		if _, err := git(ctx, dir, "fetch", "--quiet", "--", "origin", e.Commit); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	_, err := git(ctx, dir, "checkout", "--quiet", "--detach", e.Commit)
+	return errors.Trace(err)
+}
+
+// changedFiles lists the files changed by a pull request, or by a push whose payload did not say.
+func (s *Server) changedFiles(ctx context.Context, e *Event, dir string) ([]string, error) {
+	base := e.Before
+	baseURL := ""
+	if e.Kind == EventPullRequest {
+		base, baseURL = e.BaseCommit, e.BaseCloneURL
+		if s.config.CloneURL != "" {
+			baseURL = s.config.CloneURL
+		}
+	}
+	if base == "" || base == zeroCommit {
+		return nil, errors.Errorf("there is no commit to compare %s with", shortCommit(e.Commit))
+	}
+	if _, err := git(ctx, dir, "cat-file", "-e", base+"^{commit}"); err != nil && baseURL != "" {
+		if _, err := git(ctx, dir, "fetch", "--quiet", "--", baseURL, e.BaseBranch); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	out, err := git(ctx, dir, "diff", "--name-only", base+"..."+e.Commit, "--")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	files := []string{}
+	for _, file := range strings.Split(out, "\n") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// git runs a git command in dir and returns its output.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := proc.Run(ctx, cmd); err != nil {
+		return "", errors.Annotatef(err, "git %s failed:\n%s", strings.Join(args, " "), stderr)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,242 @@
+// Package webhook runs pipelines when a forge such as Gitea or GitHub reports a push or a pull request.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Kinds of events that can trigger a build.
+const (
+	EventPush        = "push"
+	EventPullRequest = "pull_request"
+)
+
+// Forges that can send events.
+const (
+	ForgeGitHub = "github"
+	ForgeGitea  = "gitea"
+)
+
+// zeroCommit is the commit a forge reports as the new head of a deleted branch or tag.
+const zeroCommit = "0000000000000000000000000000000000000000"
+
+// Event is a push or pull request event, whichever forge it came from.
+type Event struct {
+	Forge string `json:"forge"`
+	Kind  string `json:"kind"`
+	// Action is what happened to a pull request, e.g. "opened" or "synchronize".
+	Action string `json:"action,omitempty"`
+	// Repo is the full name of the repository, e.g. "owner/name".
+	Repo     string `json:"repo"`
+	CloneURL string `json:"cloneURL"`
+	// Ref is the ref that was pushed, or the head ref of a pull request.
+	Ref    string `json:"ref"`
+	Branch string `json:"branch,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	// Commit is the commit to build.
+	Commit string `json:"commit"`
+	// Before is the commit the pushed ref pointed to before the push.
+	Before string `json:"before,omitempty"`
+	// BaseBranch and BaseCommit are what a pull request would be merged into, in the repository at BaseCloneURL.
+	BaseBranch   string `json:"baseBranch,omitempty"`
+	BaseCommit   string `json:"baseCommit,omitempty"`
+	BaseCloneURL string `json:"baseCloneURL,omitempty"`
+	Number       int    `json:"number,omitempty"`
+	// ChangedFiles are the files changed by the push, or nil if the payload does not say.
+	ChangedFiles []string `json:"changedFiles,omitempty"`
+	// Deleted is set when a push deleted a branch or tag.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type repository struct {
+	FullName string `json:"full_name"`
+	CloneURL string `json:"clone_url"`
+}
+
+type pushPayload struct {
+	Ref        string     `json:"ref"`
+	Before     string     `json:"before"`
+	After      string     `json:"after"`
+	Deleted    bool       `json:"deleted"`
+	Repository repository `json:"repository"`
+	Commits    []struct {
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
+	} `json:"commits"`
+}
+
+type branchRef struct {
+	Ref  string     `json:"ref"`
+	SHA  string     `json:"sha"`
+	Repo repository `json:"repo"`
+}
+
+type pullRequestPayload struct {
+	Action      string     `json:"action"`
+	Number      int        `json:"number"`
+	Repository  repository `json:"repository"`
+	PullRequest struct {
+		Head branchRef `json:"head"`
+		Base branchRef `json:"base"`
+	} `json:"pull_request"`
+}
+
+// EventType returns the forge that sent a webhook request and the type of event it reports,
+// from the request's headers. Gitea also sends GitHub's header, so its own one is checked first.
+func EventType(header http.Header) (forge, kind string) {
+	if kind := header.Get("X-Gitea-Event"); kind != "" {
+		return ForgeGitea, kind
+	}
+	return ForgeGitHub, header.Get("X-GitHub-Event")
+}
+
+// VerifySignature checks the HMAC-SHA256 signature of a webhook payload against the shared secret.
+// GitHub sends it as `sha256=<hex>` in X-Hub-Signature-256, Gitea as plain hex in X-Gitea-Signature.
+func VerifySignature(header http.Header, body []byte, secret string) error {
+	signature := strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+	if signature == "" {
+		signature = header.Get("X-Gitea-Signature")
+	}
+	if signature == "" {
+		return errors.Unauthorizedf("webhook request is not signed")
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.Unauthorizedf("webhook signature is malformed")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.Unauthorizedf("webhook signature does not match")
+	}
+	return nil
+}
+
+// ParseEvent parses the payload of a webhook request. Events other than pushes and pull requests
+// give an error satisfying errors.IsNotSupported.
+func ParseEvent(header http.Header, body []byte) (*Event, error) {
+	forge, kind := EventType(header)
+	switch kind {
+	case EventPush:
+		payload := &pushPayload{}
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, errors.NotValidf("push payload: %s", err)
+		}
+		e := &Event{
+			Forge:    forge,
+			Kind:     EventPush,
+			Repo:     payload.Repository.FullName,
+			CloneURL: payload.Repository.CloneURL,
+			Ref:      payload.Ref,
+			Commit:   payload.After,
+			Before:   payload.Before,
+			Deleted:  payload.Deleted || payload.After == zeroCommit,
+		}
+		switch {
+		case strings.HasPrefix(e.Ref, "refs/heads/"):
+			e.Branch = strings.TrimPrefix(e.Ref, "refs/heads/")
+		case strings.HasPrefix(e.Ref, "refs/tags/"):
+			e.Tag = strings.TrimPrefix(e.Ref, "refs/tags/")
+		}
+		seen := map[string]bool{}
+		for _, commit := range payload.Commits {
+			for _, files := range [][]string{commit.Added, commit.Removed, commit.Modified} {
+				for _, file := range files {
+					if !seen[file] {
+						seen[file] = true
+						e.ChangedFiles = append(e.ChangedFiles, file)
+					}
+				}
+			}
+		}
+		return e, errors.Trace(e.validate())
+	case EventPullRequest:
+		payload := &pullRequestPayload{}
+		if err := json.Unmarshal(body, payload); err != nil {
+			return nil, errors.NotValidf("pull request payload: %s", err)
+		}
+		head, base := payload.PullRequest.Head, payload.PullRequest.Base
+		e := &Event{
+			Forge:        forge,
+			Kind:         EventPullRequest,
+			Action:       payload.Action,
+			Repo:         payload.Repository.FullName,
+			CloneURL:     head.Repo.CloneURL,
+			Ref:          "refs/heads/" + head.Ref,
+			Branch:       head.Ref,
+			Commit:       head.SHA,
+			BaseBranch:   base.Ref,
+			BaseCommit:   base.SHA,
+			Number:       payload.Number,
+			BaseCloneURL: base.Repo.CloneURL,
+		}
+		if e.CloneURL == "" {
+			e.CloneURL = payload.Repository.CloneURL
+		}
+		if e.BaseCloneURL == "" {
+			e.BaseCloneURL = payload.Repository.CloneURL
+		}
+		return e, errors.Trace(e.validate())
+	case "":
+		return nil, errors.NotValidf("webhook request without an event type")
+	default:
+		return nil, errors.NotSupportedf("%s event '%s'", forge, kind)
+	}
+}
+
+// validate checks that the event has what is needed to build it. Commits and branches end up
+// on git's command line, so they are checked not to be anything else, such as options.
+func (e *Event) validate() error {
+	switch {
+	case e.Repo == "" || e.CloneURL == "":
+		return errors.NotValidf("%s event without a repository", e.Kind)
+	case e.Commit == "":
+		return errors.NotValidf("%s event without a commit", e.Kind)
+	case !isCommitHash(e.Commit):
+		return errors.NotValidf("commit '%s'", e.Commit)
+	case e.Before != "" && !isCommitHash(e.Before):
+		return errors.NotValidf("commit '%s'", e.Before)
+	case e.BaseCommit != "" && !isCommitHash(e.BaseCommit):
+		return errors.NotValidf("commit '%s'", e.BaseCommit)
+	case strings.HasPrefix(e.Branch, "-") || strings.HasPrefix(e.BaseBranch, "-"):
+		return errors.NotValidf("%s event with a branch starting with '-'", e.Kind)
+	}
+	return nil
+}
+
+// isCommitHash reports whether s is a full SHA-1 or SHA-256 commit hash.
+func isCommitHash(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// String describes the event for logs.
+func (e *Event) String() string {
+	switch {
+	case e.Kind == EventPullRequest:
+		return fmt.Sprintf("pull request #%d of %s (%s) at %s", e.Number, e.Repo, e.Branch, shortCommit(e.Commit))
+	case e.Tag != "":
+		return fmt.Sprintf("push of tag %s of %s at %s", e.Tag, e.Repo, shortCommit(e.Commit))
+	default:
+		return fmt.Sprintf("push to %s of %s at %s", e.Branch, e.Repo, shortCommit(e.Commit))
+	}
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
@@ -0,0 +1,189 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+// payload reads a recorded webhook payload from testdata.
+func payload(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// sign returns the HMAC-SHA256 signature of body, as hex.
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func giteaHeader(event string) http.Header {
+	header := http.Header{}
+	header.Set("X-Gitea-Event", event)
+	// Gitea sends GitHub's header as well
+	header.Set("X-GitHub-Event", event)
+	return header
+}
+
+func githubHeader(event string) http.Header {
+	header := http.Header{}
+	header.Set("X-GitHub-Event", event)
+	return header
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := payload(t, "gitea_push.json")
+	tests := []struct {
+		name   string
+		header http.Header
+		ok     bool
+	}{
+		{"github", http.Header{"X-Hub-Signature-256": {"sha256=" + sign(body, "s3cret")}}, true},
+		{"gitea", http.Header{"X-Gitea-Signature": {sign(body, "s3cret")}}, true},
+		{"wrong secret", http.Header{"X-Gitea-Signature": {sign(body, "other")}}, false},
+		{"other body", http.Header{"X-Hub-Signature-256": {"sha256=" + sign(append(body, ' '), "s3cret")}}, false},
+		{"malformed", http.Header{"X-Hub-Signature-256": {"sha256=not-hex"}}, false},
+		{"missing", http.Header{}, false},
+	}
+	for _, test := range tests {
+		err := VerifySignature(test.header, body, "s3cret")
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if !test.ok && !errors.IsUnauthorized(err) {
+			t.Errorf("%s: expected an unauthorized error, got %v", test.name, err)
+		}
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		file   string
+		header http.Header
+		want   *Event
+	}{{
+		file:   "gitea_push.json",
+		header: giteaHeader(EventPush),
+		want: &Event{
+			Forge:        ForgeGitea,
+			Kind:         EventPush,
+			Repo:         "homelab/nanoci",
+			CloneURL:     "https://gitea.example.com/homelab/nanoci.git",
+			Ref:          "refs/heads/main",
+			Branch:       "main",
+			Commit:       "9f1e2d3c4b5a69788776655443322110ffeeddcc",
+			Before:       "3c0b3f2bd4d3e5f9a5b2c1d0e9f8a7b6c5d4e3f2",
+			ChangedFiles: []string{"docs/index.md", "README.md", "ci/main.go"},
+		},
+	}, {
+		file:   "gitea_pull_request.json",
+		header: giteaHeader(EventPullRequest),
+		want: &Event{
+			Forge:        ForgeGitea,
+			Kind:         EventPullRequest,
+			Action:       "synchronized",
+			Repo:         "homelab/nanoci",
+			CloneURL:     "https://gitea.example.com/sam/nanoci.git",
+			Ref:          "refs/heads/go-matrix",
+			Branch:       "go-matrix",
+			Commit:       "a1b2c3d4e5f60718293a4b5c6d7e8f9001122334",
+			BaseBranch:   "main",
+			BaseCommit:   "3c0b3f2bd4d3e5f9a5b2c1d0e9f8a7b6c5d4e3f2",
+			BaseCloneURL: "https://gitea.example.com/homelab/nanoci.git",
+			Number:       12,
+		},
+	}, {
+		file:   "github_push_tag.json",
+		header: githubHeader(EventPush),
+		want: &Event{
+			Forge:    ForgeGitHub,
+			Kind:     EventPush,
+			Repo:     "homelabtools/nanoci",
+			CloneURL: "https://github.com/homelabtools/nanoci.git",
+			Ref:      "refs/tags/v1.2.0",
+			Tag:      "v1.2.0",
+			Commit:   "5d41402abc4b2a76b9719d911017c592ae3f1c2b",
+			Before:   zeroCommit,
+		},
+	}, {
+		file:   "github_push_deleted.json",
+		header: githubHeader(EventPush),
+		want: &Event{
+			Forge:    ForgeGitHub,
+			Kind:     EventPush,
+			Repo:     "homelabtools/nanoci",
+			CloneURL: "https://github.com/homelabtools/nanoci.git",
+			Ref:      "refs/heads/old-feature",
+			Branch:   "old-feature",
+			Commit:   zeroCommit,
+			Before:   "5d41402abc4b2a76b9719d911017c592ae3f1c2b",
+			Deleted:  true,
+		},
+	}, {
+		file:   "github_pull_request.json",
+		header: githubHeader(EventPullRequest),
+		want: &Event{
+			Forge:        ForgeGitHub,
+			Kind:         EventPullRequest,
+			Action:       "opened",
+			Repo:         "homelabtools/nanoci",
+			CloneURL:     "https://github.com/sam/nanoci.git",
+			Ref:          "refs/heads/retry",
+			Branch:       "retry",
+			Commit:       "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c",
+			BaseBranch:   "main",
+			BaseCommit:   "356a192b7913b04c54574d18c28d46e6395428ab",
+			BaseCloneURL: "https://github.com/homelabtools/nanoci.git",
+			Number:       42,
+		},
+	}}
+	for _, test := range tests {
+		got, err := ParseEvent(test.header, payload(t, test.file))
+		if err != nil {
+			t.Errorf("%s: %s", test.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got\n%+v\nwant\n%+v", test.file, got, test.want)
+		}
+	}
+}
+
+func TestParseEventErrors(t *testing.T) {
+	push := string(payload(t, "gitea_push.json"))
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		check  func(error) bool
+	}{
+		{"unsupported event", githubHeader("issues"), `{}`, errors.IsNotSupported},
+		{"no event type", http.Header{}, push, errors.IsNotValid},
+		{"malformed payload", githubHeader(EventPush), `{"ref": 1}`, errors.IsNotValid},
+		{"no repository", githubHeader(EventPush), `{"ref": "refs/heads/main", "after": "9f1e2d3c4b5a69788776655443322110ffeeddcc"}`, errors.IsNotValid},
+		{"option as commit", giteaHeader(EventPush), strings.Replace(push, `"after": "9f1e2d3c4b5a69788776655443322110ffeeddcc"`, `"after": "--upload-pack=touch /tmp/pwned"`, 1), errors.IsNotValid},
+		{"short commit", giteaHeader(EventPush), strings.Replace(push, `"after": "9f1e2d3c4b5a69788776655443322110ffeeddcc"`, `"after": "9f1e2d3"`, 1), errors.IsNotValid},
+		{"option as branch", giteaHeader(EventPush), strings.Replace(push, `"ref": "refs/heads/main"`, `"ref": "refs/heads/--force"`, 1), errors.IsNotValid},
+		{"option as base commit", giteaHeader(EventPullRequest), strings.Replace(string(payload(t, "gitea_pull_request.json")), `"sha": "3c0b3f2bd4d3e5f9a5b2c1d0e9f8a7b6c5d4e3f2"`, `"sha": "-o"`, 1), errors.IsNotValid},
+	}
+	for _, test := range tests {
+		_, err := ParseEvent(test.header, []byte(test.body))
+		if !test.check(err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/homelabtools/nanoci/builder"
+	"github.com/juju/errors"
+)
+
+// RunsHandler serves the runs recorded by builds as plain text, for commit statuses to link to.
+// It expects the path /runs/<run> for the summary of a run, and /runs/<run>/logs/<task path> for
+// the log of one of its tasks.
+func RunsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/runs/"), "/", 3)
+		if parts[0] == "" || strings.Contains(parts[0], "..") {
+			http.NotFound(w, r)
+			return
+		}
+		record, err := builder.LoadRun(parts[0])
+		if errors.IsNotFound(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		switch {
+		case len(parts) == 1 || parts[1] == "":
+			fmt.Fprintf(w, "Run:      %s\n", record.ID)
+			fmt.Fprintf(w, "Pipeline: %s\n", record.Pipeline)
+			fmt.Fprintf(w, "Status:   %s\n", record.Status)
+			fmt.Fprintf(w, "Started:  %s\n", record.Start.Format(time.RFC3339))
+			fmt.Fprintf(w, "Duration: %s\n", record.Duration.Round(time.Millisecond))
+			if record.Git.Commit != "" {
+				fmt.Fprintf(w, "Commit:   %s %s\n", record.Git.Commit, record.Git.Subject)
+				fmt.Fprintf(w, "Branch:   %s\n", record.Git.Branch)
+			}
+			fmt.Fprintln(w)
+			record.Result.PrintSummary(w)
+			fmt.Fprintf(w, "\nTask logs are at %s/logs/<task path>\n", strings.TrimSuffix(r.URL.Path, "/"))
+		case len(parts) == 3 && parts[1] == "logs":
+			output, err := builder.TaskLog(record.ID, parts[2])
+			if errors.IsNotFound(err) {
+				http.NotFound(w, r)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, output)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,279 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/homelabtools/nanoci/builder"
+	"github.com/homelabtools/nanoci/forge"
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// maxPayloadSize limits how much of a webhook request is read.
+const maxPayloadSize = 10 << 20
+
+// Config configures which events a Server builds and how.
+type Config struct {
+	// Secret is the secret shared with the forge that webhook payloads are signed with.
+	// NewServer refuses to serve without one unless Insecure is set.
+	Secret string
+	// Insecure accepts unsigned payloads when there is no Secret. As builds run the code of the
+	// repository a payload names, anyone who can reach the server can then run code on it.
+	Insecure bool
+	// Branches, Tags and Paths are glob patterns that branches, tags and changed files must match
+	// for an event to be built. Without Branches and Tags every branch and tag is built, once either
+	// is set only what it lists is, so that setting just Tags builds no branches. An empty Paths
+	// matches everything. A pattern ending in /** matches everything below a directory. Pull requests
+	// are matched on the branch they target.
+	Branches []string
+	Tags     []string
+	Paths    []string
+	// BuilderDir is the directory of the builder module within the repository, "ci" by default.
+	BuilderDir string
+	// BuilderArgs are passed to the builder on its command line.
+	BuilderArgs []string
+	// PassEnv names variables of the server's environment to pass to builders, on top of a few
+	// harmless ones such as PATH and HOME. Builders of pull requests run untrusted code, so this
+	// should not include credentials unless only trusted branches are built.
+	PassEnv []string
+	// WorkspaceDir is where a fresh workspace is created for each build, by default the
+	// workspaces directory in StateDir.
+	WorkspaceDir string
+	// StateDir is where the builder records its runs, by default $NANOCI_STATE_DIR or .nanoci.
+	StateDir string
+	// CloneURL, if set, is cloned instead of the URL in the payload, e.g. a local mirror.
+	CloneURL string
+	// KeepWorkspaces keeps workspaces after their builds instead of deleting them.
+	KeepWorkspaces bool
+	// Concurrency is how many builds may run at once, 1 by default.
+	Concurrency int
+	// Reporters set commit statuses on the forge each event came from, keyed by forge, e.g. ForgeGitea.
+	// They must know the URL of their forge, as that in a payload cannot be trusted with their token.
+	Reporters map[string]forge.Reporter
+	// Statuses says how pipelines are mapped onto commit statuses.
+	Statuses forge.Mapping
+	// RunURL is where commit statuses link to, with the ID of the run appended, see RunsHandler.
+	// Builders get the link to their run in $NANOCI_RUN_URL, e.g. for notifications.
+	RunURL string
+}
+
+// Server accepts webhook requests and builds the events they report, one queue for all repositories.
+type Server struct {
+	config Config
+	queue  chan *Event
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewServer returns a server that builds events until Close is called. It makes the builder
+// package use the server's state directory, so that builder.LoadRun finds the runs of its builds.
+func NewServer(config Config) (*Server, error) {
+	if config.Secret == "" && !config.Insecure {
+		return nil, errors.NotValidf("webhook server without a secret")
+	}
+	if config.BuilderDir == "" {
+		config.BuilderDir = "ci"
+	}
+	if config.StateDir == "" {
+		config.StateDir = os.Getenv("NANOCI_STATE_DIR")
+	}
+	if config.StateDir == "" {
+		config.StateDir = ".nanoci"
+	}
+	stateDir, err := filepath.Abs(config.StateDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	config.StateDir = stateDir
+	builder.StateDir(stateDir)
+	if config.WorkspaceDir == "" {
+		config.WorkspaceDir = filepath.Join(stateDir, "workspaces")
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	s := &Server{config: config, queue: make(chan *Event, 100)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for i := 0; i < config.Concurrency; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+	return s, nil
+}
+
+func (s *Server) stateDir() string {
+	return s.config.StateDir
+}
+
+func (s *Server) workspaceDir() string {
+	return s.config.WorkspaceDir
+}
+
+// Close stops accepting events and waits for the queued builds to finish. Cancelling ctx kills them instead.
+func (s *Server) Close(ctx context.Context) {
+	close(s.queue)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+	}
+}
+
+// work builds queued events until the queue is closed.
+func (s *Server) work() {
+	defer s.wg.Done()
+	for e := range s.queue {
+		build, err := s.Build(s.ctx, e)
+		if err != nil {
+			log.Error().Msgf("Build of %s failed: %s", e, errors.ErrorStack(err))
+			continue
+		}
+		if build.Skipped != "" {
+			log.Info().Msgf("Not building %s: %s", e, build.Skipped)
+			continue
+		}
+		log.Info().Msgf("Build %s of %s finished: %s", build.ID, e, build.Status)
+	}
+}
+
+// ServeHTTP accepts a webhook request, queueing the event it reports if it should be built.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "webhooks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		http.Error(w, "unable to read payload", http.StatusBadRequest)
+		return
+	}
+	if s.config.Secret != "" {
+		if err := VerifySignature(r.Header, body, s.config.Secret); err != nil {
+			log.Warn().Msgf("Rejected webhook from %s: %s", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	e, err := ParseEvent(r.Header, body)
+	switch {
+	case errors.IsNotSupported(err):
+		respond(w, http.StatusOK, "ignored", err.Error())
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok, reason := s.Match(e); !ok {
+		log.Info().Msgf("Not building %s: %s", e, reason)
+		respond(w, http.StatusOK, "ignored", reason)
+		return
+	}
+	select {
+	case s.queue <- e:
+		log.Info().Msgf("Queued %s", e)
+		respond(w, http.StatusAccepted, "queued", e.String())
+	default:
+		http.Error(w, "too many builds are queued", http.StatusServiceUnavailable)
+	}
+}
+
+// respond writes a small JSON response saying what was done with a webhook request.
+func respond(w http.ResponseWriter, code int, status, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"status": status, "message": message})
+}
+
+// Match reports whether an event should be built, and if not, why. Changed paths are only checked
+// if the event lists them; those of pull requests are checked once they are checked out, see Build.
+func (s *Server) Match(e *Event) (bool, string) {
+	switch {
+	case e.Kind == EventPush && e.Deleted:
+		return false, fmt.Sprintf("%s was deleted", e.Ref)
+	case e.Kind == EventPush && e.Branch == "" && e.Tag == "":
+		return false, fmt.Sprintf("%s is neither a branch nor a tag", e.Ref)
+	case e.Kind == EventPullRequest && !buildsPullRequestAction(e.Action):
+		return false, fmt.Sprintf("pull request was %s", e.Action)
+	case e.Kind == EventPullRequest && !s.matchesRef(s.config.Branches, e.BaseBranch):
+		return false, fmt.Sprintf("target branch %s %s", e.BaseBranch, describePatterns(s.config.Branches, "branches"))
+	case e.Tag != "" && !s.matchesRef(s.config.Tags, e.Tag):
+		return false, fmt.Sprintf("tag %s %s", e.Tag, describePatterns(s.config.Tags, "tags"))
+	case e.Kind == EventPush && e.Tag == "" && !s.matchesRef(s.config.Branches, e.Branch):
+		return false, fmt.Sprintf("branch %s %s", e.Branch, describePatterns(s.config.Branches, "branches"))
+	case e.ChangedFiles != nil && !s.matchesPaths(e.ChangedFiles):
+		return false, fmt.Sprintf("no changed file matches %s", strings.Join(s.config.Paths, ", "))
+	}
+	return true, ""
+}
+
+// buildsPullRequestAction reports whether a pull request action changes what would be built.
+// Gitea calls an update "synchronized" and GitHub "synchronize".
+func buildsPullRequestAction(action string) bool {
+	switch action {
+	case "opened", "reopened", "synchronize", "synchronized":
+		return true
+	}
+	return false
+}
+
+// matchesRef reports whether a branch or tag matches the configured patterns for its kind.
+// Without any Branches or Tags everything matches, otherwise an empty list matches nothing.
+func (s *Server) matchesRef(patterns []string, name string) bool {
+	if len(s.config.Branches) == 0 && len(s.config.Tags) == 0 {
+		return true
+	}
+	return len(patterns) > 0 && matchesAny(patterns, name)
+}
+
+// describePatterns says why a branch or tag was not matched by patterns.
+func describePatterns(patterns []string, kind string) string {
+	if len(patterns) == 0 {
+		return "is not built, no " + kind + " are configured"
+	}
+	return "does not match " + strings.Join(patterns, ", ")
+}
+
+// matchesPaths reports whether any of the files match the configured paths.
+func (s *Server) matchesPaths(files []string) bool {
+	if len(s.config.Paths) == 0 {
+		return true
+	}
+	for _, file := range files {
+		if matchesAny(s.config.Paths, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether name matches any of the glob patterns, or whether there are none.
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/**") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "**")) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestNewServerWithoutSecret(t *testing.T) {
+	_, err := NewServer(Config{StateDir: t.TempDir()})
+	if !errors.IsNotValid(err) {
+		t.Fatalf("expected a server without a secret to be refused, got %v", err)
+	}
+	s, err := NewServer(Config{StateDir: t.TempDir(), Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close(context.Background())
+}
+
+func TestMatch(t *testing.T) {
+	push := &Event{Kind: EventPush, Ref: "refs/heads/main", Branch: "main", ChangedFiles: []string{"docs/index.md"}}
+	tag := &Event{Kind: EventPush, Ref: "refs/tags/v1.2.0", Tag: "v1.2.0"}
+	pr := &Event{Kind: EventPullRequest, Action: "synchronized", Branch: "go-matrix", BaseBranch: "main"}
+	tests := []struct {
+		name   string
+		config Config
+		event  *Event
+		want   bool
+	}{
+		{"no filters", Config{}, push, true},
+		{"branch", Config{Branches: []string{"main"}}, push, true},
+		{"branch glob", Config{Branches: []string{"release/*", "ma*"}}, push, true},
+		{"other branch", Config{Branches: []string{"release/*"}}, push, false},
+		{"tag", Config{Tags: []string{"v*"}}, tag, true},
+		{"other tag", Config{Tags: []string{"release-*"}}, tag, false},
+		{"tag is not matched on branches", Config{Branches: []string{"main"}}, tag, false},
+		{"branch is not matched on tags", Config{Tags: []string{"v*"}}, push, false},
+		{"branch and tag", Config{Branches: []string{"main"}, Tags: []string{"v*"}}, tag, true},
+		{"pull request without branches", Config{Tags: []string{"v*"}}, pr, false},
+		{"neither branch nor tag", Config{}, &Event{Kind: EventPush, Ref: "refs/notes/commits"}, false},
+		{"path below directory", Config{Paths: []string{"docs/**"}}, push, true},
+		{"other path", Config{Paths: []string{"ci/**", "*.go"}}, push, false},
+		{"paths not listed", Config{Paths: []string{"ci/**"}}, &Event{Kind: EventPush, Branch: "main"}, true},
+		{"deleted", Config{}, &Event{Kind: EventPush, Ref: "refs/heads/old", Branch: "old", Deleted: true}, false},
+		{"pull request target", Config{Branches: []string{"main"}}, pr, true},
+		{"pull request other target", Config{Branches: []string{"release/*"}}, pr, false},
+		{"pull request opened", Config{}, &Event{Kind: EventPullRequest, Action: "opened", BaseBranch: "main"}, true},
+		{"pull request synchronize", Config{}, &Event{Kind: EventPullRequest, Action: "synchronize", BaseBranch: "main"}, true},
+		{"pull request closed", Config{}, &Event{Kind: EventPullRequest, Action: "closed", BaseBranch: "main"}, false},
+		{"pull request labeled", Config{}, &Event{Kind: EventPullRequest, Action: "labeled", BaseBranch: "main"}, false},
+	}
+	for _, test := range tests {
+		s := &Server{config: test.config}
+		got, reason := s.Match(test.event)
+		if got != test.want {
+			t.Errorf("%s: got %v (%s), want %v", test.name, got, reason, test.want)
+		}
+		if !got && reason == "" {
+			t.Errorf("%s: no reason given", test.name)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	push := payload(t, "gitea_push.json")
+	deleted := payload(t, "github_push_deleted.json")
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		body   []byte
+		code   int
+		status string
+	}{
+		{"queued", http.MethodPost, signed(giteaHeader(EventPush), push), push, http.StatusAccepted, "queued"},
+		{"unsigned", http.MethodPost, giteaHeader(EventPush), push, http.StatusUnauthorized, ""},
+		{"bad signature", http.MethodPost, signed(giteaHeader(EventPush), deleted), push, http.StatusUnauthorized, ""},
+		{"not matched", http.MethodPost, signed(githubHeader(EventPush), deleted), deleted, http.StatusOK, "ignored"},
+		{"unsupported event", http.MethodPost, signed(githubHeader("ping"), []byte(`{}`)), []byte(`{}`), http.StatusOK, "ignored"},
+		{"malformed", http.MethodPost, signed(githubHeader(EventPush), []byte(`[]`)), []byte(`[]`), http.StatusBadRequest, ""},
+		{"GET", http.MethodGet, signed(giteaHeader(EventPush), push), push, http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		s := &Server{config: Config{Secret: "s3cret"}, queue: make(chan *Event, 1)}
+		r := httptest.NewRequest(test.method, "/", bytes.NewReader(test.body))
+		r.Header = test.header
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, w.Body, test.code)
+			continue
+		}
+		if test.status != "" {
+			response := map[string]string{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			} else if response["status"] != test.status {
+				t.Errorf("%s: got status %s, want %s", test.name, response["status"], test.status)
+			}
+		}
+		queued := len(s.queue) == 1
+		if queued != (test.status == "queued") {
+			t.Errorf("%s: event queued: %v", test.name, queued)
+		}
+	}
+}
+
+// signed adds the Gitea signature of body to a header.
+func signed(header http.Header, body []byte) http.Header {
+	header.Set("X-Gitea-Signature", sign(body, "s3cret"))
+	return header
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/homelabtools/nanoci/builder"
+	"github.com/homelabtools/nanoci/codegen"
+	"github.com/homelabtools/nanoci/forge"
+	"github.com/juju/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// statusReporter reports the progress of a build to the forge its event came from.
+// A nil statusReporter reports nothing.
+type statusReporter struct {
+	reporter forge.Reporter
+	mapping  forge.Mapping
+	event    *Event
+}
+
+// statusReporter returns the reporter for a build, or nil if its forge has none.
+func (s *Server) statusReporter(b *Build) *statusReporter {
+	reporter := s.config.Reporters[b.Event.Forge]
+	if reporter == nil {
+		return nil
+	}
+	mapping := s.config.Statuses
+	if s.config.RunURL != "" {
+		mapping.TargetURL = s.config.RunURL + b.ID
+	}
+	return &statusReporter{reporter: reporter, mapping: mapping, event: b.Event}
+}
+
+// needsPlan reports whether the statuses depend on the plan of the pipeline.
+func (r *statusReporter) needsPlan() bool {
+	return r != nil && r.mapping.Mode == forge.ModeStages
+}
+
+func (r *statusReporter) pending(ctx context.Context, plan *builder.PlanStep) {
+	if r != nil {
+		r.report(ctx, r.mapping.Pending(plan))
+	}
+}
+
+func (r *statusReporter) finished(ctx context.Context, result *builder.Result) {
+	if r != nil {
+		r.report(ctx, r.mapping.Finished(result))
+	}
+}
+
+func (r *statusReporter) failed(ctx context.Context, plan *builder.PlanStep, err error) {
+	if r != nil {
+		r.report(ctx, r.mapping.Failed(plan, err))
+	}
+}
+
+// report sets the statuses of the event's commit. Failures are only logged, they do not affect the build.
+func (r *statusReporter) report(ctx context.Context, statuses []forge.Status) {
+	for _, status := range statuses {
+		err := r.reporter.SetStatus(ctx, r.event.Repo, r.event.Commit, status)
+		if err != nil {
+			log.Warn().Msgf("Unable to report status of %s: %s", r.event, err)
+		}
+	}
+}
+
+// plan runs the builder to find out what it would do.
+func plan(ctx context.Context, program *codegen.Program) (*builder.PlanStep, error) {
+	args := program.Args
+	defer func() {
+		program.Args = args
+		program.Stdout = nil
+	}()
+	out := &bytes.Buffer{}
+	program.Args = append(append([]string{}, args...), "--plan", "json")
+	program.Stdout = out
+	if err := program.RunContext(ctx, nil); err != nil {
+		return nil, errors.Annotatef(err, "unable to plan the pipeline")
+	}
+	step := &builder.PlanStep{}
+	if err := json.Unmarshal(out.Bytes(), step); err != nil {
+		return nil, errors.Annotatef(err, "unable to read the plan of the pipeline")
+	}
+	return step, nil
+}